@@ -62,6 +62,22 @@ func main() {
 					Value: "",
 					Usage: "Tor controller password",
 				},
+				cli.BoolTFlag{
+					Name:  "isolate-streams",
+					Usage: "Use separate Tor circuits for each peer",
+				},
+				cli.BoolFlag{
+					Name:  "mirror",
+					Usage: "Mirror feeds of followed peers",
+				},
+				cli.BoolFlag{
+					Name:  "stream",
+					Usage: "Stream new posts of followed peers",
+				},
+				cli.BoolFlag{
+					Name:  "approve-followers",
+					Usage: "Approve subscriptions of new followers manually",
+				},
 			},
 		},
 		// help command
@@ -140,11 +156,17 @@ func startServer(c *cli.Context) {
 	config.TorConfig.ControlHost = c.String("control-host")
 	config.TorConfig.ControlPort = c.Int("control-port")
 	config.TorConfig.ControlPassword = c.String("control-password")
+	config.TorConfig.IsolateStreams = c.BoolT("isolate-streams")
+	config.Mirror = c.Bool("mirror")
+	config.Stream = c.Bool("stream")
+	config.ApproveFollowers = c.Bool("approve-followers")
 	// Create app
 	a, err := app.NewApp(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Start background workers
+	a.Start()
 	// Start APIs
 	go public.StartApi(a)
 	private.StartApi(a)
@@ -1,31 +1,146 @@
 /*
+GET /
+	Get recent timeline (optional filters: limit={n}, tag={tag}, list={id}),
+	hiding muted and blocked peers and posts matching keyword or regex rules
+POST /
+	Publish article (optionally as a reply to a post of any node)
+PUT /posts/{id}
+	Edit own post (publishes a signed revision)
+DELETE /posts/{id}
+	Delete own post (publishes a signed tombstone)
+GET /posts/{id}/revisions
+	Get revision history of own post
+GET /posts/{onion id}/{id}/revisions
+	Get revision history of cached post by {onion id}
+GET /posts/{id}/thread
+	Get conversation thread containing own post
+GET /posts/{onion id}/{id}/thread
+	Get conversation thread containing cached post by {onion id}
+GET /posts/{id}/comments
+	Get comments on own post
+GET /posts/{onion id}/{id}/comments
+	Fetch comments on post by {onion id}
+POST /posts/{id}/comments
+	Comment on own post
+POST /posts/{onion id}/{id}/comments
+	Comment on post by {onion id}
+GET /posts/{id}/reactions
+	Get reactions to own post
+POST /posts/{onion id}/{id}/reactions
+	React to post by followed {onion id} (or remove reaction)
+GET /reactions
+	Get reactions to all own posts
+POST /posts/{onion id}/{id}/repost
+	Repost post by {onion id} (own onion id for own posts)
+GET /posts/{onion id}/{id}/subscribe
+	Make subscribe request to original author of repost {id} by {onion id}
+GET /posts/{onion id}/{id}/verify
+	Verify repost {id} by {onion id} against its original author's sign key
+GET /drafts
+	Get drafts
+POST /drafts
+	Create draft
+GET /drafts/{id}
+	Preview draft
+PUT /drafts/{id}
+	Update draft
+DELETE /drafts/{id}
+	Delete draft
+POST /drafts/{id}/publish
+	Publish draft now
+POST /drafts/{id}/schedule
+	Schedule draft for publishing at unix time (zero to unschedule)
+GET /search?q={query}
+	Search own and cached posts, comments and messages (optional filters:
+	author={onion id}, type=post|repost|comment|message, since={unix time},
+	until={unix time}, limit={n})
 GET /peers
 	Get peer list
+POST /followers/{onion id}/approve
+	Approve pending subscription of {onion id}
+POST /followers/{onion id}/reject
+	Reject pending subscription of {onion id}
+GET /rules
+	Get block, mute, keyword and regex rules (optionally ?kind={kind})
+POST /rules
+	Add rule
+DELETE /rules/{id}
+	Remove rule
+GET /lists
+	Get peer lists
+POST /lists
+	Create peer list
+GET /lists/{id}
+	Get peer list by id
+PUT /lists/{id}
+	Rename peer list
+DELETE /lists/{id}
+	Delete peer list
+POST /lists/{id}/{onion id}
+	Add {onion id} to peer list
+DELETE /lists/{id}/{onion id}
+	Remove {onion id} from peer list
 GET /subscribe/{onion id}
 	Make subscribe request to {onion id}
-*/
-
-/*
-TODO:
+GET /rekey/{onion id}
+	Rotate session keys with {onion id}
+GET /sync/{onion id}
+	Fetch feed of {onion id} now
+GET /feeds/{onion id}
+	Get verified feed log position of {onion id}
+GET /mirror/{mirror onion id}/{onion id}
+	Fetch and verify feed of {onion id} from mirror at {mirror onion id}
+POST /blobs
+	Upload blob (raw body, Content-Type header)
+GET /blobs/{hash}
+	Get local blob by hash
+GET /blobs/{onion id}/{hash}
+	Fetch blob from {onion id} and verify hash
+POST /avatar/{hash}
+	Set profile avatar to blob
+GET /messages
+	Get conversation list
+GET /messages/{onion id}
+	Read conversation with {onion id}
+POST /messages/{onion id}
+	Send direct message to {onion id}
+GET /notifications
+	Get notifications for new followers, pending subscriptions, comments,
+	mentions, reactions and messages (optional filters: unread=1, limit={n})
+POST /notifications/read
+	Mark all notifications as read
+POST /notifications/{id}/read
+	Mark notification as read
+GET /events
+	Stream timeline posts, their revisions and tombstones (as update events),
+	notifications, sync status and subscription requests as server-sent
+	events (optionally ?kind={kind},{kind}...)
 
-POST /
-	Publish article
-GET /
-	Get recent timeline
+Responses are compressed with zstd or gzip as accepted by the client.
 */
 
 package private
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/wybiral/pub/internal/app"
+	"github.com/wybiral/pub/internal/model"
 	"github.com/wybiral/pub/pkg/utils"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Interval of keep-alive comments on idle event streams.
+const eventKeepAlive = 30 * time.Second
+
 type Api struct {
 	app *app.App
 }
@@ -35,8 +150,61 @@ func StartApi(app *app.App) {
 		app: app,
 	}
 	r := mux.NewRouter().StrictSlash(true)
+	r.HandleFunc("/", api.timelineHandler).Methods("GET")
+	r.HandleFunc("/", api.publishHandler).Methods("POST")
+	r.HandleFunc("/posts/{id}", api.editHandler).Methods("PUT")
+	r.HandleFunc("/posts/{id}", api.deleteHandler).Methods("DELETE")
+	r.HandleFunc("/posts/{id}/revisions", api.revisionsHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/revisions", api.revisionsHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/thread", api.threadHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/thread", api.threadHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/comments", api.commentsHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/comments", api.commentsHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/comments", api.commentHandler).Methods("POST")
+	r.HandleFunc("/posts/{onion}/{id}/comments", api.commentHandler).Methods("POST")
+	r.HandleFunc("/posts/{id}/reactions", api.reactionsHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/reactions", api.reactHandler).Methods("POST")
+	r.HandleFunc("/reactions", api.reactionsHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/repost", api.repostHandler).Methods("POST")
+	r.HandleFunc("/posts/{onion}/{id}/subscribe", api.subscribeRepostedHandler).Methods("GET")
+	r.HandleFunc("/posts/{onion}/{id}/verify", api.verifyRepostHandler).Methods("GET")
+	r.HandleFunc("/drafts", api.draftsHandler).Methods("GET")
+	r.HandleFunc("/drafts", api.createDraftHandler).Methods("POST")
+	r.HandleFunc("/drafts/{id}", api.draftHandler).Methods("GET")
+	r.HandleFunc("/drafts/{id}", api.updateDraftHandler).Methods("PUT")
+	r.HandleFunc("/drafts/{id}", api.deleteDraftHandler).Methods("DELETE")
+	r.HandleFunc("/drafts/{id}/publish", api.publishDraftHandler).Methods("POST")
+	r.HandleFunc("/drafts/{id}/schedule", api.scheduleDraftHandler).Methods("POST")
+	r.HandleFunc("/search", api.searchHandler).Methods("GET")
 	r.HandleFunc("/peers", api.peersHandler).Methods("GET")
+	r.HandleFunc("/followers/{onion}/approve", api.approveFollowerHandler).Methods("POST")
+	r.HandleFunc("/followers/{onion}/reject", api.rejectFollowerHandler).Methods("POST")
+	r.HandleFunc("/rules", api.rulesHandler).Methods("GET")
+	r.HandleFunc("/rules", api.createRuleHandler).Methods("POST")
+	r.HandleFunc("/rules/{id}", api.deleteRuleHandler).Methods("DELETE")
+	r.HandleFunc("/lists", api.listsHandler).Methods("GET")
+	r.HandleFunc("/lists", api.createListHandler).Methods("POST")
+	r.HandleFunc("/lists/{id}", api.listHandler).Methods("GET")
+	r.HandleFunc("/lists/{id}", api.renameListHandler).Methods("PUT")
+	r.HandleFunc("/lists/{id}", api.deleteListHandler).Methods("DELETE")
+	r.HandleFunc("/lists/{id}/{onion}", api.addListMemberHandler).Methods("POST")
+	r.HandleFunc("/lists/{id}/{onion}", api.removeListMemberHandler).Methods("DELETE")
 	r.HandleFunc("/subscribe/{onion}", api.subscribeHandler).Methods("GET")
+	r.HandleFunc("/rekey/{onion}", api.rekeyHandler).Methods("GET")
+	r.HandleFunc("/sync/{onion}", api.syncHandler).Methods("GET")
+	r.HandleFunc("/feeds/{onion}", api.feedStateHandler).Methods("GET")
+	r.HandleFunc("/mirror/{mirror}/{onion}", api.mirrorHandler).Methods("GET")
+	r.HandleFunc("/blobs", api.blobUploadHandler).Methods("POST")
+	r.HandleFunc("/blobs/{hash}", api.blobHandler).Methods("GET")
+	r.HandleFunc("/blobs/{onion}/{hash}", api.peerBlobHandler).Methods("GET")
+	r.HandleFunc("/avatar/{hash}", api.avatarHandler).Methods("POST")
+	r.HandleFunc("/messages", api.conversationsHandler).Methods("GET")
+	r.HandleFunc("/messages/{onion}", api.messagesHandler).Methods("GET")
+	r.HandleFunc("/messages/{onion}", api.sendMessageHandler).Methods("POST")
+	r.HandleFunc("/notifications", api.notificationsHandler).Methods("GET")
+	r.HandleFunc("/notifications/read", api.readNotificationsHandler).Methods("POST")
+	r.HandleFunc("/notifications/{id}/read", api.readNotificationHandler).Methods("POST")
+	r.HandleFunc("/events", api.eventsHandler).Methods("GET")
 	// Create listener
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -47,32 +215,981 @@ func StartApi(app *app.App) {
 	// Print private port
 	log.Println("Private interface:", addr)
 	// Serve routes on listener
-	err = http.Serve(listener, r)
+	err = http.Serve(listener, utils.Negotiate(r, false))
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// Returns JSON encoded list of peers.
-func (api *Api) peersHandler(w http.ResponseWriter, r *http.Request) {
+// Returns JSON encoded timeline of own and followed peer posts.
+func (api *Api) timelineHandler(w http.ResponseWriter, r *http.Request) {
 	app := api.app
-	peers, err := app.Model.GetPeers()
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	tag := r.URL.Query().Get("tag")
+	if len(tag) > 0 {
+		var ok bool
+		tag, ok = model.NormalizeTag(tag)
+		if !ok {
+			utils.JsonErrorStatus(w, http.StatusBadRequest, "bad tag")
+			return
+		}
+	}
+	var list int64
+	if param := r.URL.Query().Get("list"); len(param) > 0 {
+		var parseErr error
+		list, parseErr = strconv.ParseInt(param, 10, 64)
+		if parseErr != nil {
+			utils.JsonErrorStatus(w, http.StatusBadRequest, "bad list")
+			return
+		}
+	}
+	posts, err := app.Model.GetTimeline(&model.TimelineQuery{
+		Limit: limit,
+		Tag:   tag,
+		List:  list,
+	})
 	if err != nil {
 		utils.JsonError(w, err.Error())
 		return
 	}
-	utils.JsonResponse(w, peers)
+	utils.JsonResponse(w, posts)
 }
 
-// Make a subscribe request to a peer by onion.
-func (api *Api) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+// Publish a post from JSON body.
+func (api *Api) publishHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	req := struct {
+		Type        string   `json:"type"`
+		Visibility  string   `json:"visibility"`
+		Body        string   `json:"body"`
+		Attachments []string `json:"attachments"`
+		Tags        []string `json:"tags"`
+		// Only onion and id are used, the hash is filled in from cache
+		ReplyTo *model.PostRef `json:"reply_to"`
+	}{}
+	err := utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	post := &model.Post{
+		Type:        req.Type,
+		Visibility:  req.Visibility,
+		Body:        req.Body,
+		Attachments: req.Attachments,
+		Tags:        req.Tags,
+		ReplyTo:     req.ReplyTo,
+	}
+	err = app.Self.Publish(post)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, post)
+}
+
+// Edit own post by id from JSON body.
+func (api *Api) editHandler(w http.ResponseWriter, r *http.Request) {
 	app := api.app
 	vars := mux.Vars(r)
-	onion := vars["onion"]
-	peer, err := app.Self.SubscribeRequest(app.Tor.Client, onion)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	req := struct {
+		Type        string   `json:"type"`
+		Body        string   `json:"body"`
+		Attachments []string `json:"attachments"`
+		Tags        []string `json:"tags"`
+	}{}
+	err = utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	post := &model.Post{
+		Type:        req.Type,
+		Body:        req.Body,
+		Attachments: req.Attachments,
+		Tags:        req.Tags,
+	}
+	err = app.Self.Edit(id, post)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, post)
+}
+
+// Returns JSON encoded revision history of own or cached peer post.
+func (api *Api) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	var posts []*model.Post
+	onion, ok := vars["onion"]
+	if ok {
+		posts, err = app.Model.GetPeerRevisions(onion, id)
+	} else {
+		posts, err = app.Model.GetRevisions(id)
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, posts)
+}
+
+// Returns JSON encoded conversation thread containing own or cached post.
+func (api *Api) threadHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	onion, ok := vars["onion"]
+	if !ok {
+		onion = app.Self.Onion
+	}
+	posts, err := app.Model.GetThread(onion, id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, posts)
+}
+
+// Returns JSON encoded comments on own post or fetched from peer.
+func (api *Api) commentsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	var comments []*model.Comment
+	onion, ok := vars["onion"]
+	if ok && onion != app.Self.Onion {
+		var peer *model.Peer
+		peer, err = app.Model.GetPeer(onion)
+		if err != nil {
+			utils.JsonError(w, err.Error())
+			return
+		}
+		comments, err = app.Self.FetchComments(app.Tor.PeerClient, peer, id)
+	} else {
+		comments, err = app.Model.GetComments(app.Self.Onion, id)
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, comments)
+}
+
+// Comment on own or peer post from JSON body.
+func (api *Api) commentHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	req := struct {
+		Body string `json:"body"`
+	}{}
+	err = utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	onion, ok := vars["onion"]
+	if !ok {
+		onion = app.Self.Onion
+	}
+	comment, err := app.Self.SendComment(onion, id, req.Body)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, comment)
+}
+
+// Returns JSON encoded reactions to own posts (or to one post by id).
+func (api *Api) reactionsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	var id int64
+	if _, ok := vars["id"]; ok {
+		var err error
+		id, err = strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+			return
+		}
+	}
+	reactions, err := app.Model.GetReactions(app.Self.Onion, id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, reactions)
+}
+
+// React to post of followed peer from JSON body.
+func (api *Api) reactHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	req := struct {
+		Emoji  string `json:"emoji"`
+		Remove bool   `json:"remove"`
+	}{}
+	err = utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	if len(req.Emoji) == 0 {
+		req.Emoji = model.ReactionLike
+	}
+	reaction, err := app.Self.SendReaction(vars["onion"], id, req.Emoji, req.Remove)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, reaction)
+}
+
+// Repost own or cached post.
+func (api *Api) repostHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	post, err := app.Self.Repost(vars["onion"], id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, post)
+}
+
+// Make a subscribe request to the original author of a repost.
+func (api *Api) subscribeRepostedHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	peer, err := app.Self.SubscribeReposted(app.Tor.PeerClient, vars["onion"], id)
 	if err != nil {
 		utils.JsonError(w, err.Error())
 		return
 	}
 	utils.JsonResponse(w, peer)
 }
+
+// Verify a repost against the sign key served by its original author.
+func (api *Api) verifyRepostHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	post, err := app.Self.VerifyRepost(app.Tor.PeerClient, vars["onion"], id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, post)
+}
+
+// Delete own post by id.
+func (api *Api) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	tombstone, err := app.Self.Delete(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, tombstone)
+}
+
+// Returns JSON encoded list of drafts.
+func (api *Api) draftsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	drafts, err := app.Model.GetDrafts()
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, drafts)
+}
+
+// Create a draft from JSON body.
+func (api *Api) createDraftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	draft := &model.Draft{}
+	err := utils.JsonRequest(r, draft)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = draft.Insert(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, draft)
+}
+
+// Returns JSON encoded draft by id with rendered preview.
+func (api *Api) draftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	draft, err := app.Model.GetDraft(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, draft)
+}
+
+// Update draft by id from JSON body.
+func (api *Api) updateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	draft, err := app.Model.GetDraft(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = utils.JsonRequest(r, draft)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	draft.ID = id
+	err = draft.Update(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, draft)
+}
+
+// Delete draft by id.
+func (api *Api) deleteDraftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.DeleteDraft(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, id)
+}
+
+// Publish draft by id now.
+func (api *Api) publishDraftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	post, err := app.Self.PublishDraft(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, post)
+}
+
+// Schedule draft by id from JSON body.
+func (api *Api) scheduleDraftHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	req := struct {
+		Time int64 `json:"time"`
+	}{}
+	err = utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	draft, err := app.Model.GetDraft(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	draft.Scheduled = req.Time
+	err = draft.Update(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, draft)
+}
+
+// Returns JSON encoded search results.
+func (api *Api) searchHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	query := r.URL.Query()
+	sq := &model.SearchQuery{
+		Query: query.Get("q"),
+		Onion: query.Get("author"),
+		Kind:  query.Get("type"),
+	}
+	sq.Since, _ = strconv.ParseInt(query.Get("since"), 10, 64)
+	sq.Until, _ = strconv.ParseInt(query.Get("until"), 10, 64)
+	sq.Limit, _ = strconv.Atoi(query.Get("limit"))
+	results, err := app.Model.Search(sq)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, results)
+}
+
+// Returns JSON encoded list of peers.
+func (api *Api) peersHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	peers, err := app.Model.GetPeers()
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, peers)
+}
+
+// Approve pending subscription of a peer by onion.
+func (api *Api) approveFollowerHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	peer, err := app.Model.ApproveFollower(vars["onion"])
+	if err == sql.ErrNoRows {
+		utils.JsonErrorStatus(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, peer)
+}
+
+// Reject pending subscription of a peer by onion.
+func (api *Api) rejectFollowerHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	err := app.Model.RejectFollower(vars["onion"])
+	if err == sql.ErrNoRows {
+		utils.JsonErrorStatus(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, true)
+}
+
+// Returns JSON encoded list of rules.
+func (api *Api) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	rules, err := app.Model.GetRules(r.URL.Query().Get("kind"))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, rules)
+}
+
+// Add a rule from JSON body.
+func (api *Api) createRuleHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	rule := &model.Rule{}
+	err := utils.JsonRequest(r, rule)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = rule.Insert(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, rule)
+}
+
+// Remove rule by id.
+func (api *Api) deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.DeleteRule(id)
+	if err == sql.ErrNoRows {
+		utils.JsonErrorStatus(w, http.StatusNotFound, "rule not found")
+		return
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, id)
+}
+
+// Returns JSON encoded list of peer lists.
+func (api *Api) listsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	lists, err := app.Model.GetLists()
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, lists)
+}
+
+// Create a peer list from JSON body.
+func (api *Api) createListHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	list := &model.List{}
+	err := utils.JsonRequest(r, list)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = list.Insert(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, list)
+}
+
+// Returns JSON encoded peer list by id.
+func (api *Api) listHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	list, err := app.Model.GetList(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, list)
+}
+
+// Rename peer list by id from JSON body.
+func (api *Api) renameListHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	list, err := app.Model.GetList(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	err = utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	list.Name = req.Name
+	err = list.Update(app.Model)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, list)
+}
+
+// Delete peer list by id.
+func (api *Api) deleteListHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.DeleteList(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, id)
+}
+
+// Add peer by onion to peer list.
+func (api *Api) addListMemberHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.AddListMember(id, vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	list, err := app.Model.GetList(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, list)
+}
+
+// Remove peer by onion from peer list.
+func (api *Api) removeListMemberHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.RemoveListMember(id, vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	list, err := app.Model.GetList(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, list)
+}
+
+// Make a subscribe request to a peer by onion.
+func (api *Api) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	onion := vars["onion"]
+	peer, err := app.Self.SubscribeRequest(app.Tor.PeerClient, onion)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, peer)
+}
+
+// Rotate session keys with a peer by onion.
+func (api *Api) rekeyHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	peer, err := app.Model.GetPeer(vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = app.Self.Rekey(app.Tor.PeerClient, peer)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, peer)
+}
+
+// Fetch feed of a followed peer by onion.
+func (api *Api) syncHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	peer, err := app.Model.GetPeer(vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	count, err := app.SyncPeer(peer)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, count)
+}
+
+// Returns JSON encoded verified feed log position of peer.
+func (api *Api) feedStateHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	state, err := app.Model.GetFeedState(vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, state)
+}
+
+// Fetch feed of a peer from a mirror.
+func (api *Api) mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	mirror, err := app.Self.FetchMirror(app.Tor.PeerClient, vars["mirror"], vars["onion"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, mirror)
+}
+
+// Store request body as blob.
+func (api *Api) blobUploadHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	body := http.MaxBytesReader(w, r.Body, model.MaxBlobSize)
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	blob, err := app.Model.InsertBlob(data, r.Header.Get("Content-Type"))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, blob)
+}
+
+// Serve raw local blob content by hash.
+func (api *Api) blobHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	blob, err := app.Model.GetBlob(vars["hash"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	utils.BlobResponse(w, blob.Data)
+}
+
+// Fetch blob from peer (verifying hash) and serve raw content.
+func (api *Api) peerBlobHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	blob, err := app.Model.FetchBlob(app.Tor.PeerClient, vars["onion"], vars["hash"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.BlobResponse(w, blob.Data)
+}
+
+// Set profile avatar to blob by hash.
+func (api *Api) avatarHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	err := app.Self.SetAvatar(vars["hash"])
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, app.Self)
+}
+
+// Returns JSON encoded list of conversations.
+func (api *Api) conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	conversations, err := app.Model.GetConversations()
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, conversations)
+}
+
+// Returns JSON encoded conversation with peer and marks it as read.
+func (api *Api) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	onion := vars["onion"]
+	messages, err := app.Model.GetMessages(onion)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = app.Model.MarkMessagesRead(onion)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, messages)
+}
+
+// Queue a direct message to peer from JSON body.
+func (api *Api) sendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	req := struct {
+		Body string `json:"body"`
+	}{}
+	err := utils.JsonRequest(r, &req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	msg, err := app.Self.SendMessage(vars["onion"], req.Body)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, msg)
+}
+
+// Returns JSON encoded list of notifications (newest first).
+func (api *Api) notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	query := r.URL.Query()
+	limit := 100
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	unread := query.Get("unread") == "1"
+	notifications, err := app.Model.GetNotifications(unread, limit)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, notifications)
+}
+
+// Mark all notifications as read.
+func (api *Api) readNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	err := app.Model.MarkNotificationsRead(0)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, true)
+}
+
+// Mark notification as read by id.
+func (api *Api) readNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil || id < 1 {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	err = app.Model.MarkNotificationsRead(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, id)
+}
+
+// Stream events from the model event bus as server-sent events.
+func (api *Api) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.JsonError(w, "streaming unsupported")
+		return
+	}
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(r.URL.Query().Get("kind"), ",") {
+		if len(kind) > 0 {
+			kinds[kind] = true
+		}
+	}
+	events := app.Model.Subscribe()
+	defer app.Model.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			// Feed log entries are streamed to followers only
+			if e.Kind == model.EventEntry || (len(kinds) > 0 && !kinds[e.Kind]) {
+				continue
+			}
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				log.Println("events:", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data)
+		}
+		flusher.Flush()
+	}
+}
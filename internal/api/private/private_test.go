@@ -0,0 +1,52 @@
+package private
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/wybiral/pub/internal/app"
+	"github.com/wybiral/pub/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestBadParams(t *testing.T) {
+	m, err := model.NewModel(filepath.Join(t.TempDir(), "pub.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.CreateSelf("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.GetSelf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &Api{app: &app.App{Model: m, Self: s}}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		vars    map[string]string
+	}{
+		{"timeline tag", api.timelineHandler, "/?tag=%23", nil},
+		{"timeline list", api.timelineHandler, "/?list=x", nil},
+		{"post id", api.deleteHandler, "/posts/x", map[string]string{"id": "x"}},
+		{"rule id", api.deleteRuleHandler, "/rules/x", map[string]string{"id": "x"}},
+		{"list id", api.listHandler, "/lists/x", map[string]string{"id": "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.vars != nil {
+				r = mux.SetURLVars(r, tt.vars)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
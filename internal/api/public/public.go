@@ -1,41 +1,110 @@
 /*
+GET /
+	Read posts, edited posts as their latest revision, with reaction counts
+	(optionally authenticated to read subscribers-only posts)
+GET /?tag={tag}
+	Read posts tagged with {tag}
+GET /?since={seq}
+	Read feed log entries after {seq} (oldest first)
+GET /posts/{id}/revisions
+	Read original post {id} and all of its signed revisions
+GET /posts/{id}/comments
+	Read signed comments on post {id}
+POST /posts/{id}/comments
+	Comment on post {id} as authenticated peer (rejected for blocked peers)
+POST /posts/{id}/reactions
+	React to post {id} as authenticated follower (rejected for blocked peers)
 GET /info
-	Peer info
+	Peer info (with most used tags)
 POST /subscribe
-	Request subscription
-*/
+	Request subscription (rejected for blocked peers)
+POST /rekey
+	Rotate session keys with authenticated peer
+GET /blobs/{hash}
+	Get blob by hash (blobs of subscribers-only posts require follower auth)
+POST /inbox
+	Receive sealed direct message from authenticated peer (rejected for blocked peers)
+POST /inbox/post
+	Receive signed post pushed by authenticated followed peer
+GET /mirror/{onion id}
+	Read mirrored feed of followed {onion id} (if mirroring is enabled)
+GET /stream
+	Stream new feed log entries (including revisions and tombstones) as
+	server-sent events to authenticated follower (limited number of
+	concurrent streams)
 
-/*
-TODO:
+GET responses with JSON content carry an ETag (except posts with keys sealed
+for followers) and, for comments and mirrors, the Last-Modified time of their
+newest entry. Conditional requests with If-None-Match or If-Modified-Since
+get an empty 304 if nothing changed.
 
-GET /
-	Read posts
-POST /
-	Post comment
+Responses are compressed with zstd or gzip as accepted by the client and
+encoded as CBOR instead of JSON if requested with Accept: application/cbor.
+Request bodies may be sent as CBOR with Content-Type: application/cbor.
 */
+
 package public
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/wybiral/pub/internal/app"
+	"github.com/wybiral/pub/internal/model"
 	"github.com/wybiral/pub/pkg/utils"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Maximum size of an inbox request body.
+const maxInboxSize = 64 << 10
+
+// Number of most used tags advertised in /info.
+const maxInfoTags = 20
+
+// Limits of concurrent streams in total and per follower.
+const (
+	maxStreams     = 32
+	maxPeerStreams = 1
+)
+
+// Streams are closed after this duration (followers reconnect).
+const streamDuration = time.Hour
+
+// Interval of keep-alive comments on idle streams.
+const streamKeepAlive = 30 * time.Second
+
 type Api struct {
 	app *app.App
+	// Number of open streams per follower onion
+	streams   map[string]int
+	streamsMu sync.Mutex
 }
 
 func StartApi(app *app.App) {
 	api := Api{
-		app: app,
+		app:     app,
+		streams: make(map[string]int),
 	}
 	r := mux.NewRouter().StrictSlash(true)
+	r.HandleFunc("/", api.postsHandler).Methods("GET")
 	r.HandleFunc("/info", api.infoGetHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/revisions", api.revisionsHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/comments", api.commentsHandler).Methods("GET")
+	r.HandleFunc("/posts/{id}/comments", api.commentHandler).Methods("POST")
+	r.HandleFunc("/posts/{id}/reactions", api.reactionHandler).Methods("POST")
 	r.HandleFunc("/subscribe", api.subscribeHandler).Methods("POST")
+	r.HandleFunc("/rekey", api.rekeyHandler).Methods("POST")
+	r.HandleFunc("/blobs/{hash}", api.blobHandler).Methods("GET")
+	r.HandleFunc("/inbox", api.inboxHandler).Methods("POST")
+	r.HandleFunc("/inbox/post", api.inboxPostHandler).Methods("POST")
+	r.HandleFunc("/mirror/{onion}", api.mirrorHandler).Methods("GET")
+	r.HandleFunc("/stream", api.streamHandler).Methods("GET")
 	// Create listener
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -52,33 +121,501 @@ func StartApi(app *app.App) {
 	// Print onion address
 	log.Println(app.Self.Onion)
 	// Serve routes on listener
-	err = http.Serve(listener, r)
+	err = http.Serve(listener, utils.Negotiate(r, true))
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Return JSON encoded list of signed posts.
+func (api *Api) postsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	reader, ok := api.reader(w, r)
+	if !ok {
+		return
+	}
+	var posts []*model.Post
+	var err error
+	if since := r.URL.Query().Get("since"); len(since) > 0 {
+		seq, parseErr := strconv.ParseInt(since, 10, 64)
+		if parseErr != nil {
+			utils.JsonErrorStatus(w, http.StatusBadRequest, "bad since")
+			return
+		}
+		posts, err = app.Model.GetPostsSince(seq)
+	} else {
+		tag := r.URL.Query().Get("tag")
+		if len(tag) > 0 {
+			tag, ok = model.NormalizeTag(tag)
+			if !ok {
+				utils.JsonErrorStatus(w, http.StatusBadRequest, "bad tag")
+				return
+			}
+		}
+		posts, err = app.Model.GetFeed(tag)
+	}
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	counts, err := app.Model.GetReactionCounts(app.Self.Onion)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	for i, post := range posts {
+		posts[i] = app.Self.PublicPost(post, reader)
+		if posts[i].Deleted {
+			continue
+		}
+		// Reactions to subscribers-only posts are only shown to followers
+		if post.Visibility == model.VisibilitySubscribers && (reader == nil || !reader.Follower) {
+			continue
+		}
+		// Reactions are counted on the original post
+		if post.Revises != 0 {
+			posts[i].Reactions = counts[post.Revises]
+		} else {
+			posts[i].Reactions = counts[post.ID]
+		}
+	}
+	postsResponse(w, r, posts)
+}
+
+// Write posts as served to reader. Keys of subscribers-only posts are sealed
+// for followers with a random nonce, so responses carrying them are never
+// cached. Posts have no Last-Modified time since reaction counts and
+// redactions change them without a newer entry.
+func postsResponse(w http.ResponseWriter, r *http.Request, posts []*model.Post) {
+	for _, p := range posts {
+		if len(p.Key) > 0 {
+			utils.JsonResponse(w, posts)
+			return
+		}
+	}
+	utils.JsonResponseCached(w, r, posts, time.Time{})
+}
+
+// Return creation time of the newest post (zero if there are none).
+func postsModified(posts []*model.Post) time.Time {
+	var created int64
+	for _, p := range posts {
+		if p.Created > created {
+			created = p.Created
+		}
+	}
+	if created == 0 {
+		return time.Time{}
+	}
+	return time.Unix(created, 0)
+}
+
+// Return JSON encoded revision history of a post.
+func (api *Api) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	reader, ok := api.reader(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	posts, err := app.Model.GetRevisions(id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	if len(posts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	for i, post := range posts {
+		posts[i] = app.Self.PublicPost(post, reader)
+	}
+	postsResponse(w, r, posts)
+}
+
+// Return JSON encoded comments on a post.
+func (api *Api) commentsHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	reader, ok := api.reader(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	_, err = app.Self.ReadablePost(id, reader)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	comments, err := app.Model.GetComments(app.Self.Onion, id)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	var modified time.Time
+	if len(comments) > 0 {
+		modified = time.Unix(comments[len(comments)-1].Created, 0)
+	}
+	utils.JsonResponseCached(w, r, comments, modified)
+}
+
+// Receive a signed comment on a post from an authenticated peer.
+func (api *Api) commentHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxSize))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	peer, err := app.Model.AuthPeer(r, body)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if api.blocked(w, peer.Onion) {
+		return
+	}
+	comment := &model.Comment{}
+	err = utils.Decode(r.Header.Get("Content-Type"), body, comment)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	if comment.Post != id {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad comment")
+		return
+	}
+	err = app.Self.ReceiveComment(peer, comment)
+	if err != nil {
+		log.Println(err)
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, true)
+}
+
+// Receive a signed reaction on a post from an authenticated follower.
+func (api *Api) reactionHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad id")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxSize))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	peer, err := app.Model.AuthPeer(r, body)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if api.blocked(w, peer.Onion) {
+		return
+	}
+	reaction := &model.Reaction{}
+	err = utils.Decode(r.Header.Get("Content-Type"), body, reaction)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	if reaction.Post != id {
+		utils.JsonErrorStatus(w, http.StatusBadRequest, "bad reaction")
+		return
+	}
+	err = app.Self.ReceiveReaction(peer, reaction)
+	if err != nil {
+		log.Println(err)
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, true)
+}
+
+// Return authenticated peer reading a GET request (nil if anonymous). Writes
+// an error response and returns false if authentication fails.
+func (api *Api) reader(w http.ResponseWriter, r *http.Request) (*model.Peer, bool) {
+	if !model.IsAuthRequest(r) {
+		return nil, true
+	}
+	peer, err := api.app.Model.AuthPeer(r, nil)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return nil, false
+	}
+	return peer, true
+}
+
+// Write an error response and return true if onion is blocked.
+func (api *Api) blocked(w http.ResponseWriter, onion string) bool {
+	if !api.app.Model.IsBlocked(onion) {
+		return false
+	}
+	utils.JsonErrorStatus(w, http.StatusForbidden, "blocked")
+	return true
+}
+
 // Return JSON encoded identity info for peers.
 func (api *Api) infoGetHandler(w http.ResponseWriter, r *http.Request) {
 	app := api.app
-	utils.JsonResponse(w, app.Self)
+	tags, err := app.Model.GetTopTags(maxInfoTags)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	info := struct {
+		*model.Self
+		Tags []string `json:"tags"`
+	}{app.Self, tags}
+	utils.JsonResponseCached(w, r, info, time.Time{})
 }
 
 // Handle a subscribe request (currently accepts all subscriptions).
 func (api *Api) subscribeHandler(w http.ResponseWriter, r *http.Request) {
 	app := api.app
 	log.Println("/subscribe")
+	onion := r.Header.Get("Peer")
+	if api.blocked(w, onion) {
+		return
+	}
 	auth, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	_, rekey, err := app.Self.SubscribeAccept(app.Tor.PeerClient, onion, auth, app.Config.ApproveFollowers)
+	if err != nil {
+		log.Println(err)
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, rekey)
+}
+
+// Handle a rekey request from an authenticated peer.
+func (api *Api) rekeyHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxSize))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	peer, err := app.Model.AuthPeer(r, body)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	req := &model.Rekey{}
+	err = utils.Decode(r.Header.Get("Content-Type"), body, req)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	reply, err := app.Self.AcceptRekey(peer, req)
+	if err != nil {
+		log.Println(err)
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, reply)
+}
+
+// Serve raw blob content by hash (blobs of subscribers-only posts only to
+// authenticated followers).
+func (api *Api) blobHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	reader, ok := api.reader(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	ok, err := app.Model.CanReadBlob(vars["hash"], reader)
+	if err != nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	blob, err := app.Model.GetBlob(vars["hash"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	utils.BlobResponse(w, blob.Data)
+}
+
+// Receive a sealed direct message from an authenticated peer.
+func (api *Api) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
 	onion := r.Header.Get("Peer")
-	peer, err := app.Self.SubscribeAccept(app.Tor.Client, onion, auth)
+	if api.blocked(w, onion) {
+		return
+	}
+	sealed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxSize))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	// Authenticating also confirms keys agreed in a pending rekey
+	peer, err := app.Model.AuthPeer(r, sealed)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	_, err = app.Self.ReceiveMessage(peer.Onion, sealed)
 	if err != nil {
 		log.Println(err)
 		utils.JsonError(w, err.Error())
 		return
 	}
-	utils.JsonResponse(w, peer)
+	utils.JsonResponse(w, true)
+}
+
+// Receive a signed post pushed by an authenticated peer we follow.
+func (api *Api) inboxPostHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxSize))
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	peer, err := app.Model.AuthPeer(r, body)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !peer.Following {
+		utils.JsonErrorStatus(w, http.StatusForbidden, "not following peer")
+		return
+	}
+	post := &model.Post{}
+	err = utils.Decode(r.Header.Get("Content-Type"), body, post)
+	if err != nil {
+		utils.JsonError(w, err.Error())
+		return
+	}
+	err = app.Self.ReceivePost(peer, post)
+	if err != nil {
+		log.Println(err)
+		utils.JsonError(w, err.Error())
+		return
+	}
+	utils.JsonResponse(w, true)
+}
+
+// Return JSON encoded mirrored feed of a followed peer.
+func (api *Api) mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	if !app.Config.Mirror {
+		http.NotFound(w, r)
+		return
+	}
+	vars := mux.Vars(r)
+	mirror, err := app.Model.GetMirror(vars["onion"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	utils.JsonResponseCached(w, r, mirror, postsModified(mirror.Posts))
+}
+
+// Reserve a stream slot for follower at onion, false if none is left.
+func (api *Api) openStream(onion string) bool {
+	api.streamsMu.Lock()
+	defer api.streamsMu.Unlock()
+	total := 0
+	for _, n := range api.streams {
+		total += n
+	}
+	if total >= maxStreams || api.streams[onion] >= maxPeerStreams {
+		return false
+	}
+	api.streams[onion]++
+	return true
+}
+
+// Release stream slot of follower at onion.
+func (api *Api) closeStream(onion string) {
+	api.streamsMu.Lock()
+	defer api.streamsMu.Unlock()
+	api.streams[onion]--
+	if api.streams[onion] <= 0 {
+		delete(api.streams, onion)
+	}
+}
+
+// Stream new feed log entries (including revisions and tombstones) to
+// authenticated follower as server-sent events until the stream duration is
+// over.
+func (api *Api) streamHandler(w http.ResponseWriter, r *http.Request) {
+	app := api.app
+	peer, err := app.Model.AuthPeer(r, nil)
+	if err != nil {
+		utils.JsonErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if api.blocked(w, peer.Onion) {
+		return
+	}
+	if !peer.Follower {
+		utils.JsonErrorStatus(w, http.StatusForbidden, "not a follower")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.JsonError(w, "streaming unsupported")
+		return
+	}
+	if !api.openStream(peer.Onion) {
+		utils.JsonErrorStatus(w, http.StatusTooManyRequests, "too many streams")
+		return
+	}
+	defer api.closeStream(peer.Onion)
+	events := app.Model.Subscribe()
+	defer app.Model.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	timeout := time.After(streamDuration)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			tp, ok := e.Data.(*model.TimelinePost)
+			if e.Kind != model.EventEntry || !ok {
+				continue
+			}
+			data, err := json.Marshal(app.Self.PublicPost(tp.Post, peer))
+			if err != nil {
+				log.Println("stream:", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: entry\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
 }
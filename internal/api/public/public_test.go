@@ -0,0 +1,188 @@
+package public
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/wybiral/pub/internal/app"
+	"github.com/wybiral/pub/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return model in a temporary database with a new self.
+func newTestSelf(t *testing.T) (*model.Model, *model.Self) {
+	t.Helper()
+	m, err := model.NewModel(filepath.Join(t.TempDir(), "pub.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.CreateSelf("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.GetSelf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, s
+}
+
+// Return api serving a new self with a follower. Returns the follower and
+// the self as known to the follower.
+func newTestApi(t *testing.T) (*Api, *model.Self, *model.Peer) {
+	t.Helper()
+	m, s := newTestSelf(t)
+	_, follower := newTestSelf(t)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	known := follower.Peer
+	known.SecretAuthKey = secret
+	known.Follower = true
+	err := known.Insert(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followed := s.Peer
+	followed.SecretAuthKey = secret
+	api := &Api{
+		app:     &app.App{Model: m, Self: s},
+		streams: make(map[string]int),
+	}
+	return api, follower, &followed
+}
+
+func TestPostsCaching(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility string
+		follower   bool
+		cached     bool
+	}{
+		{"public", model.VisibilityPublic, false, true},
+		{"public to follower", model.VisibilityPublic, true, true},
+		{"subscribers only", model.VisibilitySubscribers, false, true},
+		{"subscribers only to follower", model.VisibilitySubscribers, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, follower, followed := newTestApi(t)
+			err := api.app.Self.Publish(&model.Post{Body: "post", Visibility: tt.visibility})
+			if err != nil {
+				t.Fatal(err)
+			}
+			get := func(etag string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("GET", "/", nil)
+				if len(etag) > 0 {
+					r.Header.Set("If-None-Match", etag)
+				}
+				if tt.follower {
+					follower.AuthRequest(r, followed, nil)
+				}
+				w := httptest.NewRecorder()
+				api.postsHandler(w, r)
+				return w
+			}
+			w := get("")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if len(w.Header().Get("Last-Modified")) > 0 {
+				t.Error("posts served with Last-Modified")
+			}
+			etag := w.Header().Get("ETag")
+			if len(etag) > 0 != tt.cached {
+				t.Fatalf("got ETag %q", etag)
+			}
+			if !tt.cached {
+				return
+			}
+			w = get(etag)
+			if w.Code != http.StatusNotModified {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusNotModified)
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	api, follower, followed := newTestApi(t)
+	s := api.app.Self
+	srv := httptest.NewServer(http.HandlerFunc(api.streamHandler))
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL+"/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower.AuthRequest(req, followed, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+	// Subscribed once the headers are sent
+	p := &model.Post{Body: "original"}
+	err = s.Publish(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Edit(p.ID, &model.Post{Body: "edited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Delete(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(chan *model.Post)
+	go func() {
+		defer close(entries)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			e := &model.Post{}
+			err := json.Unmarshal([]byte(line[len("data: "):]), e)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			entries <- e
+		}
+	}()
+	tests := []struct {
+		name    string
+		seq     int64
+		revises int64
+		typ     string
+		body    string
+	}{
+		{"post", 1, 0, model.PostTypeText, "original"},
+		{"revision", 2, p.ID, model.PostTypeText, "edited"},
+		{"tombstone", 3, 0, model.PostTypeDelete, ""},
+	}
+	for _, tt := range tests {
+		var e *model.Post
+		select {
+		case e = <-entries:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: not streamed", tt.name)
+		}
+		if e == nil {
+			t.Fatalf("%s: stream closed", tt.name)
+		}
+		if e.Seq != tt.seq || e.Revises != tt.revises || e.Type != tt.typ || e.Body != tt.body {
+			t.Errorf("%s: got seq %d revises %d type %q body %q", tt.name, e.Seq, e.Revises, e.Type, e.Body)
+		}
+		if !e.Verify(followed) {
+			t.Errorf("%s: bad signature", tt.name)
+		}
+	}
+}
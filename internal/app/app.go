@@ -3,6 +3,7 @@ package app
 import (
 	"github.com/wybiral/pub/internal/model"
 	"github.com/wybiral/pub/pkg/tor"
+	"time"
 )
 
 type App struct {
@@ -13,14 +14,26 @@ type App struct {
 }
 
 type Config struct {
-	TorConfig    *tor.Config
-	DatabasePath string
+	TorConfig      *tor.Config
+	DatabasePath   string
+	OutboxInterval time.Duration
+	RekeyInterval  time.Duration
+	SyncInterval   time.Duration
+	// Serve cached feeds of followed peers at /mirror/{onion}
+	Mirror bool
+	// Keep streaming connections open to followed peers
+	Stream bool
+	// Keep subscriptions of new followers pending until approved
+	ApproveFollowers bool
 }
 
 func NewDefaultConfig() *Config {
 	return &Config{
-		TorConfig:    tor.NewDefaultConfig(),
-		DatabasePath: "database.sqlite",
+		TorConfig:      tor.NewDefaultConfig(),
+		DatabasePath:   "database.sqlite",
+		OutboxInterval: 30 * time.Second,
+		RekeyInterval:  24 * time.Hour,
+		SyncInterval:   15 * time.Minute,
 	}
 }
 
@@ -51,3 +64,14 @@ func NewApp(config *Config) (*App, error) {
 	}
 	return app, nil
 }
+
+// Start background workers.
+func (app *App) Start() {
+	go app.runOutbox()
+	go app.runRekey()
+	go app.runSync()
+	go app.runScheduler()
+	if app.Config.Stream {
+		go app.runStreams()
+	}
+}
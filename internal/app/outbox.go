@@ -0,0 +1,37 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// Periodically deliver queued outbox items, retrying failures with backoff.
+func (app *App) runOutbox() {
+	for {
+		app.deliverOutbox()
+		time.Sleep(app.Config.OutboxInterval)
+	}
+}
+
+// Attempt delivery of all outbox items that are due.
+func (app *App) deliverOutbox() {
+	items, err := app.Model.GetDueOutbox(time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Failed items are retried with their own backoff
+	client := *app.Tor.PeerClient
+	client.Retries = 0
+	for _, item := range items {
+		err = app.Self.Deliver(&client, item)
+		if err == nil {
+			continue
+		}
+		log.Println("outbox:", item.Onion, err)
+		err = item.Retry(app.Model)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
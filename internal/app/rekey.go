@@ -0,0 +1,44 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// How often to check for sessions that are due for rotation.
+const rekeyCheckInterval = 10 * time.Minute
+
+// Periodically rotate session keys and SecretAuthKey with peers.
+func (app *App) runRekey() {
+	for {
+		app.rekeyPeers()
+		time.Sleep(rekeyCheckInterval)
+	}
+}
+
+// Rekey with every peer whose session is older than RekeyInterval.
+func (app *App) rekeyPeers() {
+	peers, err := app.Model.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	maxAge := int64(app.Config.RekeyInterval / time.Second)
+	now := time.Now().Unix()
+	// Failed rekeys are retried with a new ephemeral key on the next check
+	client := *app.Tor.PeerClient
+	client.Retries = 0
+	for _, peer := range peers {
+		if !app.Self.IsRekeyInitiator(peer) {
+			continue
+		}
+		session, err := app.Model.GetSession(peer.Onion)
+		if err == nil && now-session.Created < maxAge {
+			continue
+		}
+		err = app.Self.Rekey(&client, peer)
+		if err != nil {
+			log.Println("rekey:", peer.Onion, err)
+		}
+	}
+}
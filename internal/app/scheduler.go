@@ -0,0 +1,33 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// How often to check for scheduled drafts that are due.
+const schedulerInterval = time.Minute
+
+// Periodically publish scheduled drafts. The first pass runs on startup so
+// schedules missed while the node was offline go out right away.
+func (app *App) runScheduler() {
+	for {
+		app.publishDueDrafts()
+		time.Sleep(schedulerInterval)
+	}
+}
+
+// Publish every draft scheduled at or before now.
+func (app *App) publishDueDrafts() {
+	drafts, err := app.Model.GetDueDrafts(time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, d := range drafts {
+		_, err = app.Self.PublishDraft(d.ID)
+		if err != nil {
+			log.Println("scheduler:", d.ID, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// Delay before reopening streams that were closed.
+const streamRetryInterval = 5 * time.Minute
+
+// Keep streaming connections open to followed peers (if enabled), catching
+// up with a sync before each stream is opened.
+func (app *App) runStreams() {
+	active := make(map[string]bool)
+	done := make(chan string)
+	for {
+		peers, err := app.Model.GetPeers()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, peer := range peers {
+			if !peer.Following || active[peer.Onion] {
+				continue
+			}
+			active[peer.Onion] = true
+			go func(onion string) {
+				app.streamPeer(onion)
+				done <- onion
+			}(peer.Onion)
+		}
+		timeout := time.After(streamRetryInterval)
+		for waiting := true; waiting; {
+			select {
+			case onion := <-done:
+				delete(active, onion)
+			case <-timeout:
+				waiting = false
+			}
+		}
+	}
+}
+
+// Sync followed peer and then receive its new posts until the stream closes.
+func (app *App) streamPeer(onion string) {
+	peer, err := app.Model.GetPeer(onion)
+	if err != nil || !peer.Following {
+		return
+	}
+	_, err = app.SyncPeer(peer)
+	if err != nil {
+		log.Println("stream:", onion, err)
+		return
+	}
+	_, err = app.Self.StreamPeer(app.Tor.PeerClient, peer)
+	if err != nil {
+		log.Println("stream:", onion, err)
+	}
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"github.com/wybiral/pub/internal/model"
+	"log"
+	"time"
+)
+
+// Periodically poll feeds of followed peers (fallback for missed pushes).
+func (app *App) runSync() {
+	for {
+		app.syncPeers()
+		time.Sleep(app.Config.SyncInterval)
+	}
+}
+
+// Fetch and store posts from every followed peer.
+func (app *App) syncPeers() {
+	peers, err := app.Model.GetPeers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, peer := range peers {
+		if !peer.Following {
+			continue
+		}
+		_, err = app.SyncPeer(peer)
+		if err != nil {
+			log.Println("sync:", peer.Onion, err)
+		}
+	}
+}
+
+// Fetch and store posts from peer and publish the sync status.
+func (app *App) SyncPeer(peer *model.Peer) (int, error) {
+	count, err := app.Self.SyncPeer(app.Tor.PeerClient, peer)
+	status := &model.SyncStatus{
+		Onion: peer.Onion,
+		Count: count,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	app.Model.Emit(model.EventSync, status)
+	return count, err
+}
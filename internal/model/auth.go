@@ -0,0 +1,98 @@
+package model
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Maximum clock difference allowed for authenticated requests (seconds).
+const authTTL = 60 * 15
+
+// Return MAC of request fields using shared secret.
+func authMAC(secret []byte, method, uri, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n"))
+	mac.Write([]byte(hex.EncodeToString(sum[:])))
+	return mac.Sum(nil)
+}
+
+// Authenticate request to peer using their SecretAuthKey.
+func (s *Self) AuthRequest(req *http.Request, peer *Peer, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := authMAC(
+		peer.SecretAuthKey,
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		body,
+	)
+	req.Header.Set("Peer", s.Onion)
+	req.Header.Set("Timestamp", timestamp)
+	req.Header.Set("Auth", base64.StdEncoding.EncodeToString(mac))
+}
+
+// Return true if request carries peer authentication headers.
+func IsAuthRequest(r *http.Request) bool {
+	return len(r.Header.Get("Auth")) > 0
+}
+
+// Return known peer that authenticated request (with already read body).
+func (m *Model) AuthPeer(r *http.Request, body []byte) (*Peer, error) {
+	peer, err := m.GetPeer(r.Header.Get("Peer"))
+	if err != nil {
+		return nil, errors.New("unknown peer")
+	}
+	// Verify timestamp TTL
+	timestamp := r.Header.Get("Timestamp")
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("bad timestamp")
+	}
+	difference := time.Now().Unix() - t
+	if difference < -authTTL || difference > authTTL {
+		return nil, errors.New("timestamp out of range")
+	}
+	// Verify MAC
+	mac, err := base64.StdEncoding.DecodeString(r.Header.Get("Auth"))
+	if err != nil {
+		return nil, errors.New("bad auth")
+	}
+	keys := [][]byte{peer.SecretAuthKey}
+	// Previous key stays valid until next rotation in case peer missed it
+	ss, err := m.GetSession(peer.Onion)
+	if err == nil && len(ss.PrevAuthKey) > 0 {
+		keys = append(keys, ss.PrevAuthKey)
+	}
+	// Pending key confirms a rekey we responded to
+	if err == nil && len(ss.PendingAuthKey) > 0 {
+		keys = append(keys, ss.PendingAuthKey)
+	}
+	for _, key := range keys {
+		expected := authMAC(
+			key,
+			r.Method,
+			r.URL.RequestURI(),
+			timestamp,
+			body,
+		)
+		if !hmac.Equal(mac, expected) {
+			continue
+		}
+		if ss != nil && len(ss.PendingAuthKey) > 0 && bytes.Equal(key, ss.PendingAuthKey) {
+			err = m.commitSession(peer, ss)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return peer, nil
+	}
+	return nil, errors.New("bad auth")
+}
@@ -0,0 +1,190 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+)
+
+// Maximum size of a single blob in bytes.
+const MaxBlobSize = 8 << 20
+
+const blobSchema = `
+create table if not exists Blob (
+	hash string primary key,
+	type string not null,
+	size integer not null,
+	data blob not null
+);
+`
+
+type Blob struct {
+	Hash string `json:"hash"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Data []byte `json:"-"`
+}
+
+// Return hex encoded SHA-256 hash of blob data.
+func HashBlob(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Store data as content-addressed blob (detects type if empty).
+func (m *Model) InsertBlob(data []byte, contentType string) (*Blob, error) {
+	if len(data) > MaxBlobSize {
+		return nil, errors.New("blob too large")
+	}
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(data)
+	}
+	b := &Blob{
+		Hash: HashBlob(data),
+		Type: contentType,
+		Size: int64(len(data)),
+		Data: data,
+	}
+	_, err := m.db.Exec(
+		`insert or ignore into Blob (
+			hash,
+			type,
+			size,
+			data
+		) values (
+			?,
+			?,
+			?,
+			?
+		)`,
+		b.Hash,
+		b.Type,
+		b.Size,
+		b.Data,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Return blob by hash.
+func (m *Model) GetBlob(hash string) (*Blob, error) {
+	b := &Blob{}
+	row := m.db.QueryRow(`
+		select
+			hash,
+			type,
+			size,
+			data
+		from Blob
+		where hash = ?
+	`, hash)
+	err := row.Scan(
+		&b.Hash,
+		&b.Type,
+		&b.Size,
+		&b.Data,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Return true if blob with hash is stored locally.
+func (m *Model) HasBlob(hash string) (bool, error) {
+	var count int
+	row := m.db.QueryRow(`select count(*) from Blob where hash = ?`, hash)
+	err := row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Return true if blob may be served to reader (nil when anonymous). Blobs
+// are public if referenced by a public post or an avatar. Blobs of our own
+// subscribers-only posts are only served to followers.
+func (m *Model) CanReadBlob(hash string, reader *Peer) (bool, error) {
+	pattern := "%\"" + hash + "\"%"
+	var public, subscribers int
+	row := m.db.QueryRow(`
+		select
+			(select count(*) from Post
+				where visibility = ? and attachments like ?) +
+			(select count(*) from PeerPost
+				where visibility = ? and attachments like ?) +
+			(select count(*) from Self where avatar = ?) +
+			(select count(*) from Peer where avatar = ?),
+			(select count(*) from Post
+				where visibility = ? and attachments like ?)
+	`,
+		VisibilityPublic, pattern,
+		VisibilityPublic, pattern,
+		hash,
+		hash,
+		VisibilitySubscribers, pattern,
+	)
+	err := row.Scan(&public, &subscribers)
+	if err != nil {
+		return false, err
+	}
+	if public > 0 {
+		return true, nil
+	}
+	return subscribers > 0 && reader != nil && reader.Follower, nil
+}
+
+// Delete blobs that are no longer referenced by any post or avatar.
+func (m *Model) purgeBlobs(hashes []string) error {
+	for _, hash := range hashes {
+		pattern := "%\"" + hash + "\"%"
+		var count int
+		row := m.db.QueryRow(`
+			select
+				(select count(*) from Post where attachments like ?) +
+				(select count(*) from PeerPost where attachments like ?) +
+				(select count(*) from Self where avatar = ?) +
+				(select count(*) from Peer where avatar = ?)
+		`, pattern, pattern, hash, hash)
+		err := row.Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = m.db.Exec(`delete from Blob where hash = ?`, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return blob by hash, fetching it from peer at onion if not stored locally.
+// Fetched data is only stored if it matches the requested hash.
+func (m *Model) FetchBlob(c *tor.PeerClient, onion, hash string) (*Blob, error) {
+	b, err := m.GetBlob(hash)
+	if err == nil {
+		return b, nil
+	}
+	addr := "http://" + onion + ".onion/blobs/" + hash
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(req, MaxBlobSize)
+	if err != nil {
+		return nil, err
+	}
+	// Verify content hash
+	if HashBlob(res.Body) != hash {
+		return nil, tor.BadResponse(req, errors.New("blob hash mismatch"))
+	}
+	// The type served by the peer is never trusted
+	return m.InsertBlob(res.Body, "")
+}
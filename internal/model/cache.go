@@ -0,0 +1,116 @@
+package model
+
+import (
+	"errors"
+	"github.com/wybiral/pub/pkg/tor"
+	"github.com/wybiral/pub/pkg/utils"
+	"net/http"
+	"strings"
+)
+
+const cacheSchema = `
+create table if not exists HttpCache (
+	onion string not null,
+	path string not null,
+	uri string not null,
+	etag string not null,
+	modified string not null,
+	type string not null,
+	body blob not null,
+	primary key (onion, path)
+);
+`
+
+// Validators and body of the last response from a peer endpoint.
+type httpCache struct {
+	URI      string
+	ETag     string
+	Modified string
+	Type     string
+	Body     []byte
+}
+
+// Return cached response for onion and path.
+func (m *Model) getHttpCache(onion, path string) (*httpCache, error) {
+	hc := &httpCache{}
+	row := m.db.QueryRow(`
+		select uri, etag, modified, type, body
+		from HttpCache
+		where onion = ? and path = ?
+	`, onion, path)
+	err := row.Scan(&hc.URI, &hc.ETag, &hc.Modified, &hc.Type, &hc.Body)
+	if err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// Store response for onion and path (replacing responses for other queries).
+func (m *Model) putHttpCache(onion, path string, hc *httpCache) error {
+	_, err := m.db.Exec(`
+		insert or replace into HttpCache (
+			onion,
+			path,
+			uri,
+			etag,
+			modified,
+			type,
+			body
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)
+	`, onion, path, hc.URI, hc.ETag, hc.Modified, hc.Type, hc.Body)
+	return err
+}
+
+// Perform GET request to a peer (preferring CBOR) as a conditional request
+// if a response for the same URI is cached, and decode the response of up to
+// limit bytes into v. Unchanged responses are decoded from the cache.
+func (m *Model) cachedGet(c *tor.PeerClient, req *http.Request, limit int64, v interface{}) error {
+	onion := strings.TrimSuffix(req.URL.Hostname(), ".onion")
+	path := req.URL.Path
+	uri := req.URL.RequestURI()
+	cached, err := m.getHttpCache(onion, path)
+	if err == nil && cached.URI == uri {
+		if len(cached.ETag) > 0 {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if len(cached.Modified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.Modified)
+		}
+	} else {
+		cached = nil
+	}
+	req.Header.Set("Accept", utils.ContentTypeCbor+", "+utils.ContentTypeJson)
+	res, err := c.Do(req, limit)
+	if err != nil {
+		return err
+	}
+	if res.Status == http.StatusNotModified {
+		if cached == nil {
+			return tor.BadResponse(req, errors.New("unexpected not modified"))
+		}
+		return utils.Decode(cached.Type, cached.Body, v)
+	}
+	hc := &httpCache{
+		URI:      uri,
+		ETag:     res.Header.Get("ETag"),
+		Modified: res.Header.Get("Last-Modified"),
+		Type:     res.Header.Get("Content-Type"),
+		Body:     res.Body,
+	}
+	err = utils.Decode(hc.Type, hc.Body, v)
+	if err != nil {
+		return tor.BadResponse(req, err)
+	}
+	if len(hc.ETag) > 0 || len(hc.Modified) > 0 {
+		return m.putHttpCache(onion, path, hc)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Maximum size of a comment body in bytes.
+const maxCommentSize = 16 << 10
+
+const commentSchema = `
+create table if not exists Comment (
+	id integer primary key autoincrement,
+	author string not null,
+	post integer not null,
+	onion string not null,
+	body string not null,
+	mentions string not null,
+	created integer not null,
+	signature blob not null,
+	delivered integer not null,
+	unique (onion, signature)
+);
+`
+
+// Comment on a post, stored on the node of the post author and signed by
+// the commenting peer.
+type Comment struct {
+	ID int64 `json:"id"`
+	// Onion of the post author
+	Author string `json:"author"`
+	Post   int64  `json:"post"`
+	// Onion of the commenting peer
+	Onion string `json:"onion"`
+	Body  string `json:"body"`
+	// Onions of peers mentioned in the body (resolved when commenting)
+	Mentions  []string `json:"mentions,omitempty"`
+	Created   int64    `json:"created"`
+	Signature []byte   `json:"sig"`
+	Delivered bool     `json:"delivered,omitempty"`
+	// Set when fetched comments were checked against a known sign key
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Signed portion of a comment.
+type commentContent struct {
+	Author   string   `json:"author"`
+	Post     int64    `json:"post"`
+	Onion    string   `json:"onion"`
+	Body     string   `json:"body"`
+	Mentions []string `json:"mentions,omitempty"`
+	Created  int64    `json:"created"`
+}
+
+// Return bytes covered by the comment signature.
+func (c *Comment) SignedData() []byte {
+	data, _ := json.Marshal(commentContent{
+		Author:   c.Author,
+		Post:     c.Post,
+		Onion:    c.Onion,
+		Body:     c.Body,
+		Mentions: c.Mentions,
+		Created:  c.Created,
+	})
+	return data
+}
+
+// Insert model into DB (ignored if already stored).
+func (c *Comment) Insert(m *Model) error {
+	mentions := c.Mentions
+	if mentions == nil {
+		mentions = make([]string, 0)
+	}
+	encoded, err := json.Marshal(mentions)
+	if err != nil {
+		return err
+	}
+	result, err := m.db.Exec(
+		`insert or ignore into Comment (
+			author,
+			post,
+			onion,
+			body,
+			mentions,
+			created,
+			signature,
+			delivered
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		c.Author,
+		c.Post,
+		c.Onion,
+		c.Body,
+		string(encoded),
+		c.Created,
+		c.Signature,
+		c.Delivered,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+	c.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return m.index(SearchComment, c.Onion, c.ID, c.Created, c.Body)
+}
+
+// Return comments stored for post of author onion (oldest first).
+func (m *Model) GetComments(author string, post int64) ([]*Comment, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			author,
+			post,
+			onion,
+			body,
+			mentions,
+			created,
+			signature,
+			delivered
+		from Comment
+		where author = ? and post = ?
+		order by created, id
+	`, author, post)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := make([]*Comment, 0)
+	for rows.Next() {
+		c := &Comment{}
+		var mentions string
+		err = rows.Scan(
+			&c.ID,
+			&c.Author,
+			&c.Post,
+			&c.Onion,
+			&c.Body,
+			&mentions,
+			&c.Created,
+			&c.Signature,
+			&c.Delivered,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(mentions), &c.Mentions)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+// Return own original post if reader (nil if anonymous) may read it and
+// comment or react on it.
+func (s *Self) ReadablePost(id int64, reader *Peer) (*Post, error) {
+	p, err := s.model.GetPost(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Deleted || p.Type == PostTypeDelete || p.Revises != 0 {
+		return nil, errors.New("post not found")
+	}
+	if p.Visibility == VisibilitySubscribers && (reader == nil || !reader.Follower) {
+		return nil, errors.New("post not found")
+	}
+	return p, nil
+}
+
+// Sign comment on post of author onion and store it. Comments on posts of
+// other nodes are queued for delivery to the author.
+func (s *Self) SendComment(author string, post int64, body string) (*Comment, error) {
+	if len(body) == 0 || len(body) > maxCommentSize {
+		return nil, errors.New("bad comment")
+	}
+	c := &Comment{
+		Author:  author,
+		Post:    post,
+		Onion:   s.Onion,
+		Body:    body,
+		Created: time.Now().Unix(),
+	}
+	mentions, err := s.model.resolveMentions(body)
+	if err != nil {
+		return nil, err
+	}
+	c.Mentions = mentions
+	if author == s.Onion {
+		// All of our own posts are readable to us
+		_, err := s.ReadablePost(post, &Peer{Onion: s.Onion, Follower: true})
+		if err != nil {
+			return nil, err
+		}
+		c.Delivered = true
+		c.Signature = s.Sign(c.SignedData())
+		return c, c.Insert(s.model)
+	}
+	peer, err := s.model.GetPeer(author)
+	if err != nil {
+		return nil, errors.New("unknown peer")
+	}
+	c.Signature = s.Sign(c.SignedData())
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		Onion: peer.Onion,
+		Path:  "/posts/" + strconv.FormatInt(post, 10) + "/comments",
+		Body:  data,
+		Kind:  OutboxComment,
+		Ref:   c.ID,
+	}
+	err = o.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Verify and store comment from authenticated peer on own post.
+func (s *Self) ReceiveComment(peer *Peer, c *Comment) error {
+	if c.Author != s.Onion || c.Onion != peer.Onion {
+		return errors.New("bad comment")
+	}
+	if len(c.Body) == 0 || len(c.Body) > maxCommentSize {
+		return errors.New("bad comment")
+	}
+	if !peer.Verify(c.SignedData(), c.Signature) {
+		return errors.New("bad comment signature")
+	}
+	_, err := s.ReadablePost(c.Post, peer)
+	if err != nil {
+		return err
+	}
+	c.Delivered = true
+	c.ID = 0
+	err = c.Insert(s.model)
+	if err != nil || c.ID == 0 {
+		return err
+	}
+	return s.model.notify(NotifyComment, peer.Onion, c.Post, c.Body)
+}
+
+// Fetch comments on post of peer (authenticated), checking signatures of
+// commenters we know. Comments failing verification are dropped.
+func (s *Self) FetchComments(c *tor.PeerClient, peer *Peer, post int64) ([]*Comment, error) {
+	addr := "http://" + peer.Onion + ".onion/posts/" + strconv.FormatInt(post, 10) + "/comments"
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.AuthRequest(req, peer, nil)
+	fetched := make([]*Comment, 0)
+	err = s.model.cachedGet(c, req, maxFeedSize, &fetched)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]*Comment, 0, len(fetched))
+	for _, comment := range fetched {
+		if comment.Author != peer.Onion || comment.Post != post {
+			continue
+		}
+		commenter, err := s.model.GetPeer(comment.Onion)
+		if comment.Onion == s.Onion {
+			commenter, err = &s.Peer, nil
+		}
+		comment.Verified = false
+		if err == nil {
+			if !commenter.Verify(comment.SignedData(), comment.Signature) {
+				continue
+			}
+			comment.Verified = true
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestSendCommentOwnPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility string
+		deleted    bool
+		err        string
+	}{
+		{"public", VisibilityPublic, false, ""},
+		{"subscribers only", VisibilitySubscribers, false, ""},
+		{"deleted", VisibilityPublic, true, "post not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, s := newTestSelf(t)
+			p := &Post{Body: "post", Visibility: tt.visibility}
+			err := s.Publish(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.deleted {
+				_, err = s.Delete(p.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			c, err := s.SendComment(s.Onion, p.ID, "comment")
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.err {
+				t.Fatalf("got %q, want %q", got, tt.err)
+			}
+			if err == nil && !c.Delivered {
+				t.Error("comment on own post not delivered")
+			}
+		})
+	}
+}
@@ -2,33 +2,296 @@ package model
 
 import (
 	"database/sql"
-	"os"
+	"errors"
+	"strconv"
+	"strings"
 )
 
-const dbSchema = selfSchema + peerSchema
+const dbSchema = selfSchema + peerSchema + blobSchema + postSchema +
+	messageSchema + outboxSchema + sessionSchema + peerPostSchema + draftSchema +
+	commentSchema + reactionSchema + searchSchema + tagSchema +
+	listSchema + ruleSchema + notificationSchema + cacheSchema
 
-// Get SQL instance from DB path string.
+// Migrations of databases created by earlier versions (applied in order).
+// PRAGMA user_version holds the number of applied migrations. Missing tables
+// are created from dbSchema before migrating, and columns are only added if
+// missing, so databases created by any earlier version are brought up to date.
+var migrations = []func(tx *sql.Tx) error{
+	// Avatars
+	addColumns(
+		"Self", "avatar string not null default ''",
+		"Peer", "avatar string not null default ''",
+	),
+	// Markdown posts
+	addColumns(
+		"Post", "type string not null default 'text'",
+	),
+	// Subscribers-only posts
+	addColumns(
+		"Peer", "follower integer not null default 0",
+		"Peer", "following integer not null default 0",
+		"Post", "visibility string not null default 'public'",
+		"Post", "sealed blob not null default x''",
+		"Post", "key blob not null default x''",
+	),
+	// Feed log
+	addColumns(
+		"Post", "seq integer not null default 0",
+		"Post", "prev string not null default ''",
+		"Post", "hash string not null default ''",
+		"PeerPost", "seq integer not null default 0",
+		"PeerPost", "prev string not null default ''",
+		"PeerPost", "hash string not null default ''",
+	),
+	// Tombstones
+	addColumns(
+		"Post", "target integer not null default 0",
+		"Post", "deleted integer not null default 0",
+		"PeerPost", "target integer not null default 0",
+		"PeerPost", "deleted integer not null default 0",
+	),
+	// Revisions
+	addColumns(
+		"Post", "revises integer not null default 0",
+		"PeerPost", "revises integer not null default 0",
+	),
+	// Threaded replies
+	addColumns(
+		"Post", "reply_onion string not null default ''",
+		"Post", "reply_id integer not null default 0",
+		"Post", "reply_hash string not null default ''",
+		"PeerPost", "reply_onion string not null default ''",
+		"PeerPost", "reply_id integer not null default 0",
+		"PeerPost", "reply_hash string not null default ''",
+	),
+	// Reposts
+	addColumns(
+		"Post", "repost string not null default ''",
+		"PeerPost", "repost string not null default ''",
+	),
+	// Tags
+	addColumns(
+		"Post", "tags string not null default '[]'",
+		"PeerPost", "tags string not null default '[]'",
+		"Draft", "tags string not null default '[]'",
+	),
+	// Mentions
+	addColumns(
+		"Post", "mentions string not null default '[]'",
+		"PeerPost", "mentions string not null default '[]'",
+		"Comment", "mentions string not null default '[]'",
+	),
+	// Content negotiation
+	addColumns(
+		"HttpCache", "type string not null default 'application/json'",
+	),
+	// Chain posts published before the feed log
+	chainPosts,
+	// Confirmed rekeying
+	addColumns(
+		"Session", "pending_session_key blob not null default x''",
+		"Session", "pending_auth_key blob not null default x''",
+	),
+	// Sticky feed errors
+	addColumns(
+		"FeedState", "error_seq integer not null default 0",
+	),
+	// Enforced foreign keys (drop list members that aren't known peers)
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			delete from ListMember where onion not in (select onion from Peer)
+		`)
+		return err
+	},
+	// Pending subscriptions
+	addColumns(
+		"Peer", "pending integer not null default 0",
+	),
+	// Reply verification by hash
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			create index if not exists post_hash on Post (hash);
+			create index if not exists peer_post_hash on PeerPost (onion, hash);
+		`)
+		return err
+	},
+	// Drop members of deleted lists (list references are only enforced on
+	// new databases)
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			delete from ListMember where list not in (select id from List)
+		`)
+		return err
+	},
+}
+
+// Get SQL instance from DB path string (creating and migrating the schema).
+// Foreign keys are enforced on every connection.
 func getDatabase(dbPath string) (*sql.DB, error) {
-	_, err := os.Stat(dbPath)
-	create := false
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=1")
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Keep track if db file doesn't exist
-			create = true
-		} else {
-			return nil, err
-		}
+		return nil, err
+	}
+	// Search needs FTS5 which go-sqlite3 only includes if built with the tag
+	var fts5 bool
+	err = db.QueryRow(`select sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5)
+	if err != nil {
+		return nil, err
+	}
+	if !fts5 {
+		db.Close()
+		return nil, errors.New("sqlite3 built without FTS5 (build with -tags sqlite_fts5)")
+	}
+	// Create tables missing from new or earlier databases
+	_, err = db.Exec(dbSchema)
+	if err != nil {
+		return nil, err
 	}
-	db, err := sql.Open("sqlite3", dbPath)
+	err = migrate(db)
 	if err != nil {
 		return nil, err
 	}
-	if create {
-		// Create tables if new db file
-		_, err = db.Exec(dbSchema)
+	return db, nil
+}
+
+// Apply pending migrations, each in its own transaction.
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow(`pragma user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = migrations[version](tx)
+		if err == nil {
+			// Pragmas don't take bound parameters
+			_, err = tx.Exec(`pragma user_version = ` + strconv.Itoa(version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return db, nil
+	return nil
+}
+
+// Return migration adding columns given as pairs of table and column
+// definition (skipping columns that exist).
+func addColumns(columns ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for i := 0; i+1 < len(columns); i += 2 {
+			table, column := columns[i], columns[i+1]
+			name := strings.Fields(column)[0]
+			ok, err := hasColumn(tx, table, name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			_, err = tx.Exec(`alter table ` + table + ` add column ` + column)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Return true if table has column name.
+func hasColumn(tx *sql.Tx, table, name string) (bool, error) {
+	rows, err := tx.Query(`select name from pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return false, err
+		}
+		if column == name {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Append own posts published before the feed log to it (signing them again
+// with their position) and drop cached peer posts that can't be verified.
+func chainPosts(tx *sql.Tx) error {
+	s := &Self{}
+	err := tx.QueryRow(`select onion, private_sign_key from Self`).Scan(
+		&s.Onion,
+		&s.PrivateSignKey,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var seq int64
+	var prev string
+	err = tx.QueryRow(`
+		select seq, hash from Post
+		where seq = (select max(seq) from Post)
+	`).Scan(&seq, &prev)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	rows, err := tx.Query(`
+		select ` + postColumns + `
+		from Post
+		where seq = 0
+		order by id
+	`)
+	if err != nil {
+		return err
+	}
+	posts := make([]*Post, 0)
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	for _, p := range posts {
+		seq++
+		p.Seq = seq
+		p.Prev = prev
+		p.Signature = s.Sign(p.SignedData(s.Onion))
+		p.hash = p.Hash(s.Onion)
+		_, err = tx.Exec(
+			`update Post set seq = ?, prev = ?, hash = ?, signature = ? where id = ?`,
+			p.Seq,
+			p.Prev,
+			p.hash,
+			p.Signature,
+			p.ID,
+		)
+		if err != nil {
+			return err
+		}
+		prev = p.hash
+	}
+	_, err = tx.Exec(`delete from PeerPost where seq = 0`)
+	if err != nil {
+		return err
+	}
+	// Constraints that can't be added to existing tables
+	_, err = tx.Exec(`
+		create unique index if not exists post_seq on Post (seq);
+		create unique index if not exists peer_post_seq on PeerPost (onion, seq);
+	`)
+	return err
 }
@@ -0,0 +1,335 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const draftSchema = `
+create table if not exists Draft (
+	id integer primary key autoincrement,
+	type string not null,
+	visibility string not null,
+	body string not null,
+	attachments string not null,
+	tags string not null,
+	scheduled integer not null,
+	updated integer not null
+);
+`
+
+// Draft is an unpublished post, optionally scheduled for publishing.
+type Draft struct {
+	ID          int64    `json:"id"`
+	Type        string   `json:"type"`
+	Visibility  string   `json:"visibility"`
+	Body        string   `json:"body"`
+	HTML        string   `json:"html,omitempty"`
+	Attachments []string `json:"attachments"`
+	Tags        []string `json:"tags"`
+	// Unix time to publish at (zero if not scheduled)
+	Scheduled int64 `json:"scheduled"`
+	Updated   int64 `json:"updated"`
+}
+
+// Return post that draft would be published as.
+func (d *Draft) Post() *Post {
+	return &Post{
+		Type:        d.Type,
+		Visibility:  d.Visibility,
+		Body:        d.Body,
+		Attachments: d.Attachments,
+		Tags:        d.Tags,
+	}
+}
+
+// Validate draft content and render its preview.
+func (d *Draft) normalize() error {
+	p := d.Post()
+	err := p.normalize()
+	if err != nil {
+		return err
+	}
+	d.Type = p.Type
+	d.Visibility = p.Visibility
+	d.Attachments = p.Attachments
+	d.Tags = p.Tags
+	p.Render()
+	d.HTML = p.HTML
+	return nil
+}
+
+// Insert model into DB.
+func (d *Draft) Insert(m *Model) error {
+	err := d.normalize()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(d.Attachments)
+	if err != nil {
+		return err
+	}
+	encodedTags, err := json.Marshal(d.Tags)
+	if err != nil {
+		return err
+	}
+	d.Updated = time.Now().Unix()
+	result, err := m.db.Exec(
+		`insert into Draft (
+			type,
+			visibility,
+			body,
+			attachments,
+			tags,
+			scheduled,
+			updated
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		d.Type,
+		d.Visibility,
+		d.Body,
+		string(encoded),
+		string(encodedTags),
+		d.Scheduled,
+		d.Updated,
+	)
+	if err != nil {
+		return err
+	}
+	d.ID, err = result.LastInsertId()
+	return err
+}
+
+// Update model in DB.
+func (d *Draft) Update(m *Model) error {
+	err := d.normalize()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(d.Attachments)
+	if err != nil {
+		return err
+	}
+	encodedTags, err := json.Marshal(d.Tags)
+	if err != nil {
+		return err
+	}
+	d.Updated = time.Now().Unix()
+	_, err = m.db.Exec(
+		`update Draft set
+			type = ?,
+			visibility = ?,
+			body = ?,
+			attachments = ?,
+			tags = ?,
+			scheduled = ?,
+			updated = ?
+		where id = ?`,
+		d.Type,
+		d.Visibility,
+		d.Body,
+		string(encoded),
+		string(encodedTags),
+		d.Scheduled,
+		d.Updated,
+		d.ID,
+	)
+	return err
+}
+
+// Return array of all drafts (most recently updated first).
+func (m *Model) GetDrafts() ([]*Draft, error) {
+	return m.queryDrafts(`
+		select
+			id,
+			type,
+			visibility,
+			body,
+			attachments,
+			tags,
+			scheduled,
+			updated
+		from Draft
+		order by updated desc
+	`)
+}
+
+// Return drafts scheduled at or before unix time now.
+func (m *Model) GetDueDrafts(now int64) ([]*Draft, error) {
+	return m.queryDrafts(`
+		select
+			id,
+			type,
+			visibility,
+			body,
+			attachments,
+			tags,
+			scheduled,
+			updated
+		from Draft
+		where scheduled > 0 and scheduled <= ?
+		order by scheduled
+	`, now)
+}
+
+// Return draft by id.
+func (m *Model) GetDraft(id int64) (*Draft, error) {
+	drafts, err := m.queryDrafts(`
+		select
+			id,
+			type,
+			visibility,
+			body,
+			attachments,
+			tags,
+			scheduled,
+			updated
+		from Draft
+		where id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(drafts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return drafts[0], nil
+}
+
+// Delete draft by id.
+func (m *Model) DeleteDraft(id int64) error {
+	result, err := m.db.Exec(`delete from Draft where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Return array of drafts from query.
+func (m *Model) queryDrafts(query string, args ...interface{}) ([]*Draft, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drafts := make([]*Draft, 0)
+	for rows.Next() {
+		d := &Draft{}
+		var attachments string
+		var tags string
+		err = rows.Scan(
+			&d.ID,
+			&d.Type,
+			&d.Visibility,
+			&d.Body,
+			&attachments,
+			&tags,
+			&d.Scheduled,
+			&d.Updated,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(attachments), &d.Attachments)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(tags), &d.Tags)
+		if err != nil {
+			return nil, err
+		}
+		err = d.normalize()
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, nil
+}
+
+// Publish draft by id and remove it. The draft is removed first so it can't
+// be published twice and restored if publishing fails before the entry is
+// committed.
+func (s *Self) PublishDraft(id int64) (*Post, error) {
+	d, err := s.model.GetDraft(id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.model.DeleteDraft(id)
+	if err != nil {
+		return nil, err
+	}
+	p := d.Post()
+	err = s.Publish(p)
+	if err != nil {
+		// Restore unless the entry was committed (it is published then)
+		_, gerr := s.model.GetPost(p.ID)
+		if gerr == sql.ErrNoRows {
+			d.Scheduled = 0
+			rerr := s.model.restoreDraft(d)
+			if rerr != nil {
+				return nil, fmt.Errorf("%w (draft not restored: %v)", err, rerr)
+			}
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reinsert removed draft keeping its id.
+func (m *Model) restoreDraft(d *Draft) error {
+	encoded, err := json.Marshal(d.Attachments)
+	if err != nil {
+		return err
+	}
+	encodedTags, err := json.Marshal(d.Tags)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.Exec(
+		`insert into Draft (
+			id,
+			type,
+			visibility,
+			body,
+			attachments,
+			tags,
+			scheduled,
+			updated
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		d.ID,
+		d.Type,
+		d.Visibility,
+		d.Body,
+		string(encoded),
+		string(encodedTags),
+		d.Scheduled,
+		d.Updated,
+	)
+	return err
+}
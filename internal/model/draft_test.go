@@ -0,0 +1,43 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestPublishDraft(t *testing.T) {
+	tests := []struct {
+		name        string
+		attachments []string
+		err         string
+		// Draft is kept (restored after a failed publish)
+		kept bool
+	}{
+		{"published", []string{}, "", false},
+		{"missing blob", []string{"0000"}, "blob not found", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, s := newTestSelf(t)
+			d := &Draft{Body: "draft", Attachments: tt.attachments, Scheduled: 1}
+			err := d.Insert(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.PublishDraft(d.ID)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.err {
+				t.Fatalf("got %q, want %q", got, tt.err)
+			}
+			kept, err := m.GetDraft(d.ID)
+			if (err == nil) != tt.kept {
+				t.Fatalf("got draft kept %v, want %v", err == nil, tt.kept)
+			}
+			if tt.kept && kept.Scheduled != 0 {
+				t.Error("restored draft still scheduled")
+			}
+		})
+	}
+}
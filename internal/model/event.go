@@ -0,0 +1,80 @@
+package model
+
+import (
+	"sync"
+)
+
+// Event kinds.
+const (
+	// New timeline item (TimelinePost)
+	EventPost = "post"
+	// Revision or tombstone of a timeline item (TimelinePost)
+	EventUpdate = "update"
+	// Signed entry appended to own feed log, including revisions and
+	// tombstones (TimelinePost)
+	EventEntry = "entry"
+	// New notification (Notification)
+	EventNotification = "notification"
+	// Feed of a followed peer was synced (SyncStatus)
+	EventSync = "sync"
+	// Peer sent a subscription request (Peer)
+	EventSubscribe = "subscribe"
+)
+
+// Number of events buffered per subscriber before events are dropped.
+const eventBuffer = 64
+
+// Event published on the model event bus.
+type Event struct {
+	Kind string      `json:"kind"`
+	Data interface{} `json:"data"`
+}
+
+// SyncStatus is the result of syncing the feed of a followed peer.
+type SyncStatus struct {
+	Onion string `json:"onion"`
+	// Number of entries stored
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+// Fan out of events to subscribers that never blocks publishers.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan *Event]bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan *Event]bool),
+	}
+}
+
+// Return new channel receiving all published events.
+func (m *Model) Subscribe() chan *Event {
+	ch := make(chan *Event, eventBuffer)
+	m.events.mu.Lock()
+	m.events.subscribers[ch] = true
+	m.events.mu.Unlock()
+	return ch
+}
+
+// Stop sending events to channel returned by Subscribe.
+func (m *Model) Unsubscribe(ch chan *Event) {
+	m.events.mu.Lock()
+	delete(m.events.subscribers, ch)
+	m.events.mu.Unlock()
+}
+
+// Publish event to all subscribers (dropped for subscribers that are behind).
+func (m *Model) Emit(kind string, data interface{}) {
+	e := &Event{Kind: kind, Data: data}
+	m.events.mu.Lock()
+	defer m.events.mu.Unlock()
+	for ch := range m.events.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+const listSchema = `
+create table if not exists List (
+	id integer primary key autoincrement,
+	name string not null unique,
+	created integer not null
+);
+create table if not exists ListMember (
+	list integer not null references List (id),
+	onion string not null references Peer (onion),
+	primary key (list, onion)
+);
+`
+
+// List is a user-defined group of peers with its own timeline.
+type List struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Created int64    `json:"created"`
+}
+
+// Insert model into DB.
+func (l *List) Insert(m *Model) error {
+	l.Name = strings.TrimSpace(l.Name)
+	if len(l.Name) == 0 {
+		return errors.New("bad list name")
+	}
+	l.Created = time.Now().Unix()
+	l.Members = make([]string, 0)
+	result, err := m.db.Exec(
+		`insert into List (
+			name,
+			created
+		) values (
+			?,
+			?
+		)`,
+		l.Name,
+		l.Created,
+	)
+	if err != nil {
+		return err
+	}
+	l.ID, err = result.LastInsertId()
+	return err
+}
+
+// Rename list.
+func (l *List) Update(m *Model) error {
+	l.Name = strings.TrimSpace(l.Name)
+	if len(l.Name) == 0 {
+		return errors.New("bad list name")
+	}
+	_, err := m.db.Exec(`update List set name = ? where id = ?`, l.Name, l.ID)
+	return err
+}
+
+// Return array of all lists with their members.
+func (m *Model) GetLists() ([]*List, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			name,
+			created
+		from List
+		order by name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := make([]*List, 0)
+	for rows.Next() {
+		l := &List{}
+		err = rows.Scan(
+			&l.ID,
+			&l.Name,
+			&l.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	rows.Close()
+	for _, l := range lists {
+		l.Members, err = m.getListMembers(l.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// Return list by id with its members.
+func (m *Model) GetList(id int64) (*List, error) {
+	l := &List{}
+	row := m.db.QueryRow(`
+		select
+			id,
+			name,
+			created
+		from List
+		where id = ?
+	`, id)
+	err := row.Scan(
+		&l.ID,
+		&l.Name,
+		&l.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	l.Members, err = m.getListMembers(id)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Return onions of list members.
+func (m *Model) getListMembers(id int64) ([]string, error) {
+	rows, err := m.db.Query(
+		`select onion from ListMember where list = ? order by onion`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]string, 0)
+	for rows.Next() {
+		var onion string
+		err = rows.Scan(&onion)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, onion)
+	}
+	return members, nil
+}
+
+// Delete list by id along with its members.
+func (m *Model) DeleteList(id int64) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Members go first (list references aren't enforced on upgraded
+	// databases, so they're never left to a cascade)
+	_, err = tx.Exec(`delete from ListMember where list = ?`, id)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`delete from List where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// Add known peer at onion to list.
+func (m *Model) AddListMember(id int64, onion string) error {
+	_, err := m.GetList(id)
+	if err != nil {
+		return err
+	}
+	_, err = m.GetPeer(onion)
+	if err != nil {
+		return errors.New("unknown peer")
+	}
+	_, err = m.db.Exec(
+		`insert or ignore into ListMember (list, onion) values (?, ?)`,
+		id,
+		onion,
+	)
+	return err
+}
+
+// Remove peer at onion from list.
+func (m *Model) RemoveListMember(id int64, onion string) error {
+	_, err := m.db.Exec(
+		`delete from ListMember where list = ? and onion = ?`,
+		id,
+		onion,
+	)
+	return err
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestDeleteList(t *testing.T) {
+	m, s := newTestSelf(t)
+	pm, peer := newTestSelf(t)
+	testFollow(t, m, s, pm, peer)
+	l := &List{Name: "friends"}
+	err := l.Insert(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.AddListMember(l.ID, peer.Onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.DeleteList(l.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = m.db.QueryRow(`select count(*) from ListMember`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("got %d members of deleted list", count)
+	}
+	err = m.DeleteList(l.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("deleting again: got %v, want %v", err, sql.ErrNoRows)
+	}
+	err = m.AddListMember(l.ID, peer.Onion)
+	if err == nil {
+		t.Error("added member to deleted list")
+	}
+}
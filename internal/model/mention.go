@@ -0,0 +1,55 @@
+package model
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Maximum number of mentions resolved per post or comment.
+const maxMentions = 16
+
+// Mentions are "@" followed by an onion id or a peer name, at the start of
+// the body or after a character that can't be part of an address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([\p{L}\p{N}_]+)`)
+
+// Return onions of peers mentioned in body. Mentions are resolved by onion
+// id of a known peer or by name if exactly one known peer has that name.
+func (m *Model) resolveMentions(body string) ([]string, error) {
+	peers, err := m.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	byOnion := make(map[string]bool)
+	byName := make(map[string][]string)
+	for _, peer := range peers {
+		byOnion[peer.Onion] = true
+		name := strings.ToLower(peer.Name)
+		byName[name] = append(byName[name], peer.Onion)
+	}
+	mentions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		onion := strings.ToLower(match[1])
+		if !byOnion[onion] {
+			if len(byName[onion]) != 1 {
+				continue
+			}
+			onion = byName[onion][0]
+		}
+		if !seen[onion] && len(mentions) < maxMentions {
+			seen[onion] = true
+			mentions = append(mentions, onion)
+		}
+	}
+	return mentions, nil
+}
+
+// Return true if onion is in mentions.
+func mentions(mentions []string, onion string) bool {
+	for _, m := range mentions {
+		if m == onion {
+			return true
+		}
+	}
+	return false
+}
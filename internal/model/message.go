@@ -0,0 +1,278 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const messageSchema = `
+create table if not exists Message (
+	id integer primary key autoincrement,
+	uid string not null unique,
+	peer string not null,
+	outgoing integer not null,
+	body string not null,
+	created integer not null,
+	delivered integer not null,
+	read integer not null
+);
+`
+
+type Message struct {
+	ID        int64  `json:"id"`
+	UID       string `json:"uid"`
+	Peer      string `json:"peer"`
+	Outgoing  bool   `json:"outgoing"`
+	Body      string `json:"body"`
+	Created   int64  `json:"created"`
+	Delivered bool   `json:"delivered"`
+	Read      bool   `json:"read"`
+}
+
+// Sealed portion of a message sent between peers.
+type messageContent struct {
+	UID     string `json:"uid"`
+	Body    string `json:"body"`
+	Created int64  `json:"created"`
+}
+
+type Conversation struct {
+	Peer   string   `json:"peer"`
+	Last   *Message `json:"last"`
+	Unread int64    `json:"unread"`
+}
+
+// Insert model into DB (ignored if uid already exists).
+func (msg *Message) Insert(m *Model) error {
+	result, err := m.db.Exec(
+		`insert or ignore into Message (
+			uid,
+			peer,
+			outgoing,
+			body,
+			created,
+			delivered,
+			read
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		msg.UID,
+		msg.Peer,
+		msg.Outgoing,
+		msg.Body,
+		msg.Created,
+		msg.Delivered,
+		msg.Read,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+	msg.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	// Index messages under the onion of their sender
+	onion := msg.Peer
+	if msg.Outgoing {
+		onion = m.selfOnion()
+	}
+	return m.index(SearchMessage, onion, msg.ID, msg.Created, msg.Body)
+}
+
+// Return messages exchanged with peer (oldest first).
+func (m *Model) GetMessages(onion string) ([]*Message, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			uid,
+			peer,
+			outgoing,
+			body,
+			created,
+			delivered,
+			read
+		from Message
+		where peer = ?
+		order by created, id
+	`, onion)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]*Message, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// Return one conversation per peer (most recent first).
+func (m *Model) GetConversations() ([]*Conversation, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			uid,
+			peer,
+			outgoing,
+			body,
+			created,
+			delivered,
+			read
+		from Message
+		where id in (select max(id) from Message group by peer)
+		order by id desc
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	conversations := make([]*Conversation, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, &Conversation{
+			Peer: msg.Peer,
+			Last: msg,
+		})
+	}
+	rows.Close()
+	// Count unread messages per conversation
+	for _, c := range conversations {
+		row := m.db.QueryRow(`
+			select count(*) from Message
+			where peer = ? and outgoing = 0 and read = 0
+		`, c.Peer)
+		err = row.Scan(&c.Unread)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conversations, nil
+}
+
+// Mark all incoming messages from peer as read.
+func (m *Model) MarkMessagesRead(onion string) error {
+	_, err := m.db.Exec(
+		`update Message set read = 1 where peer = ? and outgoing = 0`,
+		onion,
+	)
+	return err
+}
+
+// Scan message from row.
+func scanMessage(row interface{ Scan(...interface{}) error }) (*Message, error) {
+	msg := &Message{}
+	err := row.Scan(
+		&msg.ID,
+		&msg.UID,
+		&msg.Peer,
+		&msg.Outgoing,
+		&msg.Body,
+		&msg.Created,
+		&msg.Delivered,
+		&msg.Read,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Store message to peer and queue it (sealed) for delivery to their inbox.
+func (s *Self) SendMessage(onion, body string) (*Message, error) {
+	peer, err := s.model.GetPeer(onion)
+	if err != nil {
+		return nil, errors.New("unknown peer")
+	}
+	uid := make([]byte, 16)
+	rand.Read(uid)
+	msg := &Message{
+		UID:      hex.EncodeToString(uid),
+		Peer:     peer.Onion,
+		Outgoing: true,
+		Body:     body,
+		Created:  time.Now().Unix(),
+		Read:     true,
+	}
+	data, err := json.Marshal(messageContent{
+		UID:     msg.UID,
+		Body:    msg.Body,
+		Created: msg.Created,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = msg.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		Onion: peer.Onion,
+		Path:  "/inbox",
+		Body:  data,
+		Kind:  OutboxMessage,
+		Ref:   msg.ID,
+	}
+	err = o.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Open sealed message from known peer at onion and store it.
+func (s *Self) ReceiveMessage(onion string, sealed []byte) (*Message, error) {
+	peer, err := s.model.GetPeer(onion)
+	if err != nil {
+		return nil, errors.New("unknown peer")
+	}
+	opened, ok := s.OpenFrom(peer, sealed)
+	if !ok {
+		return nil, errors.New("box not opened")
+	}
+	content := messageContent{}
+	err = json.Unmarshal(opened, &content)
+	if err != nil {
+		return nil, err
+	}
+	if len(content.UID) == 0 {
+		return nil, errors.New("bad message")
+	}
+	msg := &Message{
+		UID:     peer.Onion + ":" + content.UID,
+		Peer:    peer.Onion,
+		Body:    content.Body,
+		Created: content.Created,
+	}
+	err = msg.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	// Redelivered messages are ignored and don't get an id
+	if msg.ID != 0 {
+		err = s.model.notify(NotifyMessage, peer.Onion, msg.ID, msg.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
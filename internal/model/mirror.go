@@ -0,0 +1,136 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wybiral/pub/pkg/tor"
+	"log"
+	"net/http"
+)
+
+// Mirrored feed of an author as served by followers.
+type Mirror struct {
+	Author *Peer   `json:"author"`
+	Posts  []*Post `json:"posts"`
+	// Set when posts were checked against a sign key of the author that
+	// wasn't served by the mirror (known locally or fetched from the author)
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Return public identity of peer (without local relationship state).
+func (p *Peer) Identity() *Peer {
+	return &Peer{
+		Onion:         p.Onion,
+		Name:          p.Name,
+		About:         p.About,
+		Avatar:        p.Avatar,
+		PublicBoxKey:  p.PublicBoxKey,
+		PublicSignKey: p.PublicSignKey,
+	}
+}
+
+// Return cached signed posts of followed peer as served to mirror readers.
+// Subscribers-only posts are served sealed.
+func (m *Model) GetMirror(onion string) (*Mirror, error) {
+	peer, err := m.GetPeer(onion)
+	if err != nil {
+		return nil, err
+	}
+	if !peer.Following {
+		return nil, errors.New("not following peer")
+	}
+	posts, err := m.queryPosts(`
+		select `+postColumns+`
+		from PeerPost
+		where onion = ?
+		order by seq desc
+	`, onion)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range posts {
+		if p.Deleted {
+			posts[i] = p.stub()
+			continue
+		}
+		if p.Visibility == VisibilitySubscribers {
+			p.Body = ""
+			p.HTML = ""
+			p.Attachments = make([]string, 0)
+			p.Tags = nil
+			p.Mentions = nil
+			p.ReplyTo = nil
+		}
+	}
+	return &Mirror{Author: peer.Identity(), Posts: posts}, nil
+}
+
+// Fetch feed of author from mirror at onion. Posts are verified against the
+// locally known sign key of author, or the key served by the author at /info.
+// If the author can't be reached either, posts are only checked against the
+// key served by the mirror and returned unverified (they are never stored).
+func (s *Self) FetchMirror(c *tor.PeerClient, mirror, author string) (*Mirror, error) {
+	addr := "http://" + mirror + ".onion/mirror/" + author
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	mr := &Mirror{}
+	err = s.model.cachedGet(c, req, maxFeedSize, mr)
+	if err != nil {
+		return nil, err
+	}
+	if mr.Author == nil || mr.Author.Onion != author {
+		return nil, errors.New("bad mirror author")
+	}
+	mr.Verified = false
+	known, err := s.model.GetPeer(author)
+	if err == nil {
+		mr.Author = known.Identity()
+		mr.Verified = true
+	} else {
+		info, err := s.model.GetPeerByOnion(c, author)
+		if err == nil && info.Onion == author {
+			mr.Author = info.Identity()
+			mr.Verified = true
+		}
+	}
+	verified := make([]*Post, 0)
+	bySeq := make(map[int64]*Post)
+	for _, p := range mr.Posts {
+		if p.Deleted {
+			p.hash = p.Redacted
+		} else if p.Verify(mr.Author) {
+			p.hash = p.Hash(author)
+		} else {
+			continue
+		}
+		p.Render()
+		verified = append(verified, p)
+		bySeq[p.Seq] = p
+	}
+	// Adjacent entries must link by hash (mirrors may have gaps)
+	for _, p := range verified {
+		prev, ok := bySeq[p.Seq-1]
+		if ok && prev.hash != p.Prev {
+			return nil, fmt.Errorf("broken chain at seq %d", p.Seq)
+		}
+	}
+	for _, p := range verified {
+		// Fill gaps in cache of followed authors (stubs served by mirrors
+		// are never stored)
+		if p.Deleted {
+			continue
+		}
+		if mr.Verified && known != nil && known.Following && !s.model.hasPeerPost(author, p.ID) {
+			// Feed errors are kept in the feed state of the author, the
+			// mirrored feed is served either way
+			err = s.ReceivePost(known, p)
+			if err != nil {
+				log.Println("mirror:", err)
+			}
+		}
+	}
+	mr.Posts = verified
+	return mr, nil
+}
@@ -6,7 +6,8 @@ import (
 )
 
 type Model struct {
-	db *sql.DB
+	db     *sql.DB
+	events *eventBus
 }
 
 // Return new model instance from DB path string.
@@ -15,5 +16,5 @@ func NewModel(dbPath string) (*Model, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Model{db: db}, nil
+	return &Model{db: db, events: newEventBus()}, nil
 }
@@ -0,0 +1,151 @@
+package model
+
+import (
+	"time"
+)
+
+// Notification kinds.
+const (
+	// Peer subscribed to us (unless kept pending)
+	NotifyFollower = "follower"
+	// Peer requested a subscription that awaits our approval
+	NotifyPending = "pending"
+	// Comment on own post
+	NotifyComment = "comment"
+	// Post of a followed peer mentioning us
+	NotifyMention = "mention"
+	// Reaction to own post
+	NotifyReaction = "reaction"
+	// Direct message
+	NotifyMessage = "message"
+)
+
+// Maximum length of the body excerpt stored with a notification.
+const maxNotificationBody = 140
+
+const notificationSchema = `
+create table if not exists Notification (
+	id integer primary key autoincrement,
+	kind string not null,
+	onion string not null,
+	ref integer not null,
+	body string not null,
+	created integer not null,
+	read integer not null
+);
+`
+
+// Notification records an event concerning us caused by peer at Onion.
+type Notification struct {
+	ID    int64  `json:"id"`
+	Kind  string `json:"kind"`
+	Onion string `json:"onion"`
+	// Id of the related post or message (zero if none)
+	Ref int64 `json:"ref,omitempty"`
+	// Excerpt of the related content
+	Body    string `json:"body,omitempty"`
+	Created int64  `json:"created"`
+	Read    bool   `json:"read"`
+}
+
+// Insert model into DB.
+func (n *Notification) Insert(m *Model) error {
+	if len([]rune(n.Body)) > maxNotificationBody {
+		n.Body = string([]rune(n.Body)[:maxNotificationBody])
+	}
+	n.Created = time.Now().Unix()
+	result, err := m.db.Exec(
+		`insert into Notification (
+			kind,
+			onion,
+			ref,
+			body,
+			created,
+			read
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		n.Kind,
+		n.Onion,
+		n.Ref,
+		n.Body,
+		n.Created,
+		n.Read,
+	)
+	if err != nil {
+		return err
+	}
+	n.ID, err = result.LastInsertId()
+	return err
+}
+
+// Record notification of kind caused by peer at onion.
+func (m *Model) notify(kind, onion string, ref int64, body string) error {
+	n := &Notification{
+		Kind:  kind,
+		Onion: onion,
+		Ref:   ref,
+		Body:  body,
+	}
+	err := n.Insert(m)
+	if err != nil {
+		return err
+	}
+	m.Emit(EventNotification, n)
+	return nil
+}
+
+// Return notifications (newest first), optionally only unread ones.
+func (m *Model) GetNotifications(unread bool, limit int) ([]*Notification, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			kind,
+			onion,
+			ref,
+			body,
+			created,
+			read
+		from Notification
+		where ? = 0 or read = 0
+		order by id desc
+		limit ?
+	`, unread, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := make([]*Notification, 0)
+	for rows.Next() {
+		n := &Notification{}
+		err = rows.Scan(
+			&n.ID,
+			&n.Kind,
+			&n.Onion,
+			&n.Ref,
+			&n.Body,
+			&n.Created,
+			&n.Read,
+		)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+// Mark notification as read by id (zero for all notifications).
+func (m *Model) MarkNotificationsRead(id int64) error {
+	_, err := m.db.Exec(
+		`update Notification set read = 1 where ? = 0 or id = ?`,
+		id,
+		id,
+	)
+	return err
+}
@@ -0,0 +1,209 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+	"time"
+)
+
+// Outbox item kinds.
+const (
+	OutboxMessage  = "message"
+	OutboxPost     = "post"
+	OutboxComment  = "comment"
+	OutboxReaction = "reaction"
+)
+
+// Retry backoff bounds for outbox delivery.
+const (
+	outboxMinDelay = 30
+	outboxMaxDelay = 60 * 60
+)
+
+const outboxSchema = `
+create table if not exists Outbox (
+	id integer primary key autoincrement,
+	onion string not null,
+	path string not null,
+	body blob not null,
+	kind string not null,
+	ref integer not null,
+	attempts integer not null,
+	next_attempt integer not null
+);
+`
+
+// Outbox is a persistent queue of requests to be delivered to peers.
+// Messages and posts are sealed for the peer at delivery time, so they use
+// the session keys current at that point.
+type Outbox struct {
+	ID          int64  `json:"id"`
+	Onion       string `json:"onion"`
+	Path        string `json:"path"`
+	Body        []byte `json:"-"`
+	Kind        string `json:"kind"`
+	Ref         int64  `json:"ref"`
+	Attempts    int64  `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+}
+
+// Insert model into DB.
+func (o *Outbox) Insert(m *Model) error {
+	result, err := m.db.Exec(
+		`insert into Outbox (
+			onion,
+			path,
+			body,
+			kind,
+			ref,
+			attempts,
+			next_attempt
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		o.Onion,
+		o.Path,
+		o.Body,
+		o.Kind,
+		o.Ref,
+		o.Attempts,
+		o.NextAttempt,
+	)
+	if err != nil {
+		return err
+	}
+	o.ID, err = result.LastInsertId()
+	return err
+}
+
+// Return outbox items due for delivery at unix time now.
+func (m *Model) GetDueOutbox(now int64) ([]*Outbox, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			onion,
+			path,
+			body,
+			kind,
+			ref,
+			attempts,
+			next_attempt
+		from Outbox
+		where next_attempt <= ?
+		order by id
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]*Outbox, 0)
+	for rows.Next() {
+		o := &Outbox{}
+		err = rows.Scan(
+			&o.ID,
+			&o.Onion,
+			&o.Path,
+			&o.Body,
+			&o.Kind,
+			&o.Ref,
+			&o.Attempts,
+			&o.NextAttempt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, o)
+	}
+	return items, nil
+}
+
+// Reschedule item with exponential backoff after a failed attempt.
+func (o *Outbox) Retry(m *Model) error {
+	o.Attempts++
+	delay := int64(outboxMinDelay)
+	for i := int64(1); i < o.Attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	o.NextAttempt = time.Now().Unix() + delay
+	_, err := m.db.Exec(
+		`update Outbox set attempts = ?, next_attempt = ? where id = ?`,
+		o.Attempts,
+		o.NextAttempt,
+		o.ID,
+	)
+	return err
+}
+
+// Mark item as delivered and remove it from the queue.
+func (o *Outbox) Done(m *Model) error {
+	if o.Kind == OutboxMessage {
+		_, err := m.db.Exec(
+			`update Message set delivered = 1 where id = ?`,
+			o.Ref,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if o.Kind == OutboxComment {
+		_, err := m.db.Exec(
+			`update Comment set delivered = 1 where id = ?`,
+			o.Ref,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := m.db.Exec(`delete from Outbox where id = ?`, o.ID)
+	return err
+}
+
+// Attempt delivery of outbox item to peer (authenticated at send time).
+func (s *Self) Deliver(c *tor.PeerClient, o *Outbox) error {
+	peer, err := s.model.GetPeer(o.Onion)
+	if err != nil {
+		return err
+	}
+	body, err := s.outboxBody(peer, o)
+	if err != nil {
+		return err
+	}
+	addr := "http://" + o.Onion + ".onion" + o.Path
+	req, err := http.NewRequest("POST", addr, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	s.AuthRequest(req, peer, body)
+	_, err = c.Do(req, maxInfoSize)
+	if err != nil {
+		return err
+	}
+	return o.Done(s.model)
+}
+
+// Return request body of outbox item for peer, sealing messages and
+// rebuilding posts with their post key wrapped for the peer.
+func (s *Self) outboxBody(peer *Peer, o *Outbox) ([]byte, error) {
+	switch o.Kind {
+	case OutboxMessage:
+		return s.SealFor(peer, o.Body), nil
+	case OutboxPost:
+		p, err := s.model.GetPost(o.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(s.PublicPost(p, peer))
+	}
+	return o.Body, nil
+}
@@ -1,19 +1,27 @@
 package model
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"database/sql"
+	"github.com/wybiral/pub/pkg/tor"
+	"golang.org/x/crypto/nacl/sign"
 	"net/http"
 )
 
+// Maximum size of fetched peer info in bytes.
+const maxInfoSize = 64 << 10
+
 const peerSchema = `
-create table Peer (
+create table if not exists Peer (
 	onion string primary key,
 	name string not null,
 	about string not null,
+	avatar string not null,
 	public_sign_key blob not null,
 	public_box_key blob not null,
-	secret_auth_key blob not null
+	secret_auth_key blob not null,
+	follower integer not null default 0,
+	following integer not null default 0,
+	pending integer not null default 0
 );
 `
 
@@ -21,9 +29,18 @@ type Peer struct {
 	Onion         string `json:"onion"`
 	Name          string `json:"name"`
 	About         string `json:"about"`
+	Avatar        string `json:"avatar"`
 	PublicBoxKey  []byte `json:"box_key"`
 	PublicSignKey []byte `json:"sign_key"`
 	SecretAuthKey []byte `json:"-"`
+	// Peer is subscribed to us
+	Follower bool `json:"follower,omitempty"`
+	// We are subscribed to peer
+	Following bool `json:"following,omitempty"`
+	// Peer requested a subscription that awaits our approval
+	Pending bool `json:"pending,omitempty"`
+	// Most used tags as advertised in /info (not stored)
+	Tags []string `json:"tags,omitempty"`
 }
 
 // Return array of all peers.
@@ -33,9 +50,13 @@ func (m *Model) GetPeers() ([]*Peer, error) {
 			onion,
 			name,
 			about,
+			avatar,
 			public_sign_key,
 			public_box_key,
-			secret_auth_key
+			secret_auth_key,
+			follower,
+			following,
+			pending
 		from Peer
 	`)
 	if err != nil {
@@ -49,9 +70,13 @@ func (m *Model) GetPeers() ([]*Peer, error) {
 			&p.Onion,
 			&p.Name,
 			&p.About,
+			&p.Avatar,
 			&p.PublicSignKey,
 			&p.PublicBoxKey,
 			&p.SecretAuthKey,
+			&p.Follower,
+			&p.Following,
+			&p.Pending,
 		)
 		if err != nil {
 			return nil, err
@@ -61,57 +86,173 @@ func (m *Model) GetPeers() ([]*Peer, error) {
 	return peers, nil
 }
 
-// Return Peer instance from onion id (and tor http client).
-func (m *Model) GetPeerByOnion(c *http.Client, onion string) (*Peer, error) {
-	addr := "http://" + onion + ".onion/info"
-	req, err := http.NewRequest("GET", addr, nil)
+// Return array of peers subscribed to us.
+func (m *Model) GetFollowers() ([]*Peer, error) {
+	peers, err := m.GetPeers()
 	if err != nil {
 		return nil, err
 	}
-	res, err := c.Do(req)
+	followers := make([]*Peer, 0)
+	for _, p := range peers {
+		if p.Follower {
+			followers = append(followers, p)
+		}
+	}
+	return followers, nil
+}
+
+// Return locally stored peer by onion id.
+func (m *Model) GetPeer(onion string) (*Peer, error) {
+	p := &Peer{}
+	row := m.db.QueryRow(`
+		select
+			onion,
+			name,
+			about,
+			avatar,
+			public_sign_key,
+			public_box_key,
+			secret_auth_key,
+			follower,
+			following,
+			pending
+		from Peer
+		where onion = ?
+	`, onion)
+	err := row.Scan(
+		&p.Onion,
+		&p.Name,
+		&p.About,
+		&p.Avatar,
+		&p.PublicSignKey,
+		&p.PublicBoxKey,
+		&p.SecretAuthKey,
+		&p.Follower,
+		&p.Following,
+		&p.Pending,
+	)
 	if err != nil {
 		return nil, err
 	}
-	data, err := ioutil.ReadAll(res.Body)
+	return p, nil
+}
+
+// Return Peer instance from onion id (and tor http client).
+func (m *Model) GetPeerByOnion(c *tor.PeerClient, onion string) (*Peer, error) {
+	addr := "http://" + onion + ".onion/info"
+	req, err := http.NewRequest("GET", addr, nil)
 	if err != nil {
 		return nil, err
 	}
-	res.Body.Close()
 	p := &Peer{}
-	err = json.Unmarshal(data, p)
+	err = m.cachedGet(c, req, maxInfoSize, p)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-// Insert model into DB.
+// Insert model into DB (merging relationship flags with an existing peer).
 func (p *Peer) Insert(m *Model) error {
 	_, err := m.db.Exec(
 		`insert into Peer (
 			onion,
 			name,
 			about,
+			avatar,
 			public_box_key,
 			public_sign_key,
-			secret_auth_key
+			secret_auth_key,
+			follower,
+			following,
+			pending
 		) values (
+			?,
+			?,
+			?,
+			?,
 			?,
 			?,
 			?,
 			?,
 			?,
 			?
-		)`,
+		) on conflict(onion) do update set
+			name = excluded.name,
+			about = excluded.about,
+			avatar = excluded.avatar,
+			public_box_key = excluded.public_box_key,
+			public_sign_key = excluded.public_sign_key,
+			secret_auth_key = excluded.secret_auth_key,
+			follower = follower or excluded.follower,
+			following = following or excluded.following,
+			pending = (pending or excluded.pending)
+				and not (follower or excluded.follower)`,
 		p.Onion,
 		p.Name,
 		p.About,
+		p.Avatar,
 		p.PublicBoxKey,
 		p.PublicSignKey,
 		p.SecretAuthKey,
+		p.Follower,
+		p.Following,
+		p.Pending,
 	)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Verify detached signature of data using peer public sign key.
+func (p *Peer) Verify(data, sig []byte) bool {
+	var publicKey [32]byte
+	if len(sig) != sign.Overhead {
+		return false
+	}
+	copy(publicKey[:], p.PublicSignKey)
+	signed := append(append([]byte{}, sig...), data...)
+	_, ok := sign.Open(nil, signed, &publicKey)
+	return ok
+}
+
+// Approve pending subscription of peer at onion making them a follower.
+// Returns sql.ErrNoRows if there's no pending subscription.
+func (m *Model) ApproveFollower(onion string) (*Peer, error) {
+	result, err := m.db.Exec(
+		`update Peer set follower = 1, pending = 0 where onion = ? and pending`,
+		onion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return m.GetPeer(onion)
+}
+
+// Reject pending subscription of peer at onion. Returns sql.ErrNoRows if
+// there's no pending subscription.
+func (m *Model) RejectFollower(onion string) error {
+	result, err := m.db.Exec(
+		`update Peer set pending = 0 where onion = ? and pending`,
+		onion,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
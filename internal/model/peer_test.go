@@ -0,0 +1,123 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Transport serving every request with a handler.
+type testTransport http.HandlerFunc
+
+func (h testTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Result(), nil
+}
+
+// Return PeerClient serving /info of selves.
+func testPeerClient(selves ...*Self) *tor.PeerClient {
+	return tor.NewPeerClient(&http.Client{
+		Transport: testTransport(func(w http.ResponseWriter, r *http.Request) {
+			for _, s := range selves {
+				if r.URL.Hostname() == s.Onion+".onion" && r.URL.Path == "/info" {
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(s.Peer)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		}),
+	})
+}
+
+// Return subscribe request auth payload from s to peer.
+func testSubscribeAuth(s *Self, peer *Peer) []byte {
+	auth := []byte("subscribe:" + strconv.FormatInt(time.Now().Unix(), 10) + ":")
+	auth = append(auth, []byte("0123456789abcdef0123456789abcdef")...)
+	return s.Seal(auth, peer.PublicBoxKey)
+}
+
+func TestSubscribeAccept(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending bool
+		// Subscription renewed by an existing follower
+		renewed bool
+		// Pending subscription approved, rejected or kept
+		decision string
+		follower bool
+		notified []string
+	}{
+		{"accepted", false, false, "", true, []string{NotifyFollower}},
+		{"pending", true, false, "", false, []string{NotifyPending}},
+		{"approved", true, false, "approve", true, []string{NotifyPending}},
+		{"rejected", true, false, "reject", false, []string{NotifyPending}},
+		{"renewed while pending", true, true, "", true, []string{NotifyFollower}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am, a := newTestSelf(t)
+			_, b := newTestSelf(t)
+			c := testPeerClient(a, b)
+			if tt.renewed {
+				_, _, err := a.SubscribeAccept(c, b.Onion, testSubscribeAuth(b, &a.Peer), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, _, err := a.SubscribeAccept(c, b.Onion, testSubscribeAuth(b, &a.Peer), tt.pending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.decision {
+			case "approve":
+				_, err = am.ApproveFollower(b.Onion)
+			case "reject":
+				err = am.RejectFollower(b.Onion)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Following doesn't resolve a pending subscription
+			known, err := am.GetPeer(b.Onion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			known.Following = true
+			err = known.Insert(am)
+			if err != nil {
+				t.Fatal(err)
+			}
+			known, err = am.GetPeer(b.Onion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := tt.pending && !tt.renewed && len(tt.decision) == 0
+			if known.Follower != tt.follower || known.Pending != pending {
+				t.Errorf("got follower %v pending %v, want follower %v pending %v", known.Follower, known.Pending, tt.follower, pending)
+			}
+			_, err = am.ApproveFollower(b.Onion)
+			if pending != (err == nil) || (err != nil && err != sql.ErrNoRows) {
+				t.Errorf("approving again: got %v", err)
+			}
+			notifications, err := am.GetNotifications(false, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kinds := make([]string, 0)
+			for _, n := range notifications {
+				kinds = append(kinds, n.Kind)
+			}
+			if strings.Join(kinds, ",") != strings.Join(tt.notified, ",") {
+				t.Errorf("got notifications %v, want %v", kinds, tt.notified)
+			}
+		})
+	}
+}
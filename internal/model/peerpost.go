@@ -0,0 +1,687 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+	"strconv"
+)
+
+// Maximum size of a fetched feed in bytes.
+const maxFeedSize = 8 << 20
+
+const peerPostSchema = `
+create table if not exists PeerPost (
+	onion string not null,
+	id integer not null,
+	seq integer not null,
+	prev string not null,
+	hash string not null,
+	type string not null,
+	visibility string not null,
+	body string not null,
+	attachments string not null,
+	target integer not null,
+	revises integer not null,
+	sealed blob not null,
+	key blob not null,
+	created integer not null,
+	signature blob not null,
+	deleted integer not null,
+	reply_onion string not null,
+	reply_id integer not null,
+	reply_hash string not null,
+	repost string not null,
+	tags string not null,
+	mentions string not null,
+	primary key (onion, id),
+	unique (onion, seq)
+);
+create table if not exists PendingStub (
+	onion string not null,
+	seq integer not null,
+	id integer not null,
+	prev string not null,
+	hash string not null,
+	primary key (onion, seq)
+);
+create table if not exists FeedState (
+	onion string primary key,
+	seq integer not null,
+	hash string not null,
+	error string not null,
+	error_seq integer not null default 0
+);
+`
+
+// Post in the timeline along with the onion of its author.
+type TimelinePost struct {
+	Onion string `json:"onion"`
+	*Post
+	// Number of known replies across all cached feeds
+	Replies int `json:"replies,omitempty"`
+	// Nesting level when returned as part of a thread
+	Depth int `json:"depth,omitempty"`
+}
+
+// FeedState is the last verified position in the feed log of a peer.
+type FeedState struct {
+	Onion string `json:"onion"`
+	Seq   int64  `json:"seq"`
+	Hash  string `json:"hash"`
+	// Last detected gap, fork or tampering (empty if none)
+	Error string `json:"error,omitempty"`
+	// Position of the detected fork or tampering (kept until an intact entry
+	// is received there, zero for gaps)
+	ErrorSeq int64 `json:"error_seq,omitempty"`
+}
+
+// Return verified feed log position of peer (zero state if never synced).
+func (m *Model) GetFeedState(onion string) (*FeedState, error) {
+	fs := &FeedState{Onion: onion}
+	row := m.db.QueryRow(`
+		select
+			seq,
+			hash,
+			error,
+			error_seq
+		from FeedState
+		where onion = ?
+	`, onion)
+	err := row.Scan(
+		&fs.Seq,
+		&fs.Hash,
+		&fs.Error,
+		&fs.ErrorSeq,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Insert model into DB (replacing existing state).
+func (fs *FeedState) Insert(m *Model) error {
+	_, err := m.db.Exec(
+		`insert or replace into FeedState (
+			onion,
+			seq,
+			hash,
+			error,
+			error_seq
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		fs.Onion,
+		fs.Seq,
+		fs.Hash,
+		fs.Error,
+		fs.ErrorSeq,
+	)
+	return err
+}
+
+// Store verified post from author peer (decrypting it if possible), apply
+// tombstones and advance the verified position of their feed log. Unsigned
+// stubs of deleted entries are only stored once authenticated.
+func (s *Self) ReceivePost(author *Peer, p *Post) error {
+	if p.Seq < 1 {
+		return errors.New("bad post seq")
+	}
+	if p.Deleted {
+		return s.model.receiveStub(author.Onion, p)
+	}
+	if !p.Verify(author) {
+		return s.model.feedError(author.Onion, p.Seq, fmt.Sprintf("bad signature at seq %d", p.Seq))
+	}
+	p.hash = p.Hash(author.Onion)
+	if p.Repost != nil && s.model.checkRepost(p.Repost) != nil {
+		return s.model.feedError(author.Onion, p.Seq, fmt.Sprintf("bad repost at seq %d", p.Seq))
+	}
+	// A different entry at the same position is a fork (cached entries are
+	// signed or authenticated stubs)
+	existing, err := s.model.getPeerPostBySeq(author.Onion, p.Seq)
+	if err == nil && existing.hash != p.hash {
+		return s.model.feedError(author.Onion, p.Seq, fmt.Sprintf("fork at seq %d", p.Seq))
+	}
+	// Keep reposts verified when cached entries are received again
+	if existing != nil && existing.Repost != nil && existing.Repost.Verified {
+		p.Repost.Verified = true
+	}
+	if p.Attachments == nil {
+		p.Attachments = make([]string, 0)
+	}
+	if p.Sealed == nil {
+		p.Sealed = []byte{}
+	}
+	if p.Key == nil {
+		p.Key = []byte{}
+	}
+	// Subscribers-only posts stay sealed if we weren't given a key
+	if p.Visibility == VisibilitySubscribers {
+		err := s.OpenPost(author, p)
+		if err != nil {
+			p.Body = ""
+			p.Attachments = make([]string, 0)
+			p.Tags = nil
+			p.Mentions = nil
+			p.ReplyTo = nil
+		}
+	}
+	values, err := postValues(p, p.Key)
+	if err != nil {
+		return err
+	}
+	_, err = s.model.db.Exec(`
+		insert or replace into PeerPost (onion, `+postColumns+`)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, append([]interface{}{author.Onion}, values...)...)
+	if err != nil {
+		return err
+	}
+	err = s.model.promoteStub(author.Onion, p.Seq-1)
+	if err != nil {
+		return err
+	}
+	err = s.model.indexPost(author.Onion, p)
+	if err != nil {
+		return err
+	}
+	err = s.model.tagPost(author.Onion, p)
+	if err != nil {
+		return err
+	}
+	// Apply signed tombstones to cached copies (in either arrival order)
+	redacted := false
+	target := p
+	if p.Type == PostTypeDelete {
+		target, err = s.model.getPeerPost(author.Onion, p.Target)
+	} else if p.Revises != 0 && s.model.isTombstoned(author.Onion, p.Revises) {
+		target, err = s.model.getPeerPost(author.Onion, p.Revises)
+	} else if !s.model.isTombstoned(author.Onion, p.ID) {
+		target = nil
+	}
+	if err == nil && target != nil && target.Type != PostTypeDelete {
+		err = s.model.redactPost("PeerPost", author.Onion, target)
+		if err != nil {
+			return err
+		}
+		redacted = true
+	}
+	// Notify once per new timeline entry (cached entries are received again
+	// when syncing and revisions would notify again)
+	if existing == nil && !s.model.isHidden(author.Onion, p) {
+		tp := &TimelinePost{Onion: author.Onion, Post: p}
+		if !redacted && p.onTimeline() {
+			if mentions(p.Mentions, s.Onion) {
+				err = s.model.notify(NotifyMention, author.Onion, p.ID, p.Body)
+				if err != nil {
+					return err
+				}
+			}
+			s.model.Emit(EventPost, tp)
+		} else if p.Type == PostTypeDelete || (p.Revises != 0 && !redacted) {
+			s.model.Emit(EventUpdate, tp)
+		}
+	}
+	return s.model.advanceFeed(author.Onion, p.Seq)
+}
+
+// Keep unsigned stub of deleted entry of peer at onion pending until the
+// signed entry after it authenticates its hash. Pending stubs never replace
+// or conflict with cached entries.
+func (m *Model) receiveStub(onion string, p *Post) error {
+	_, err := m.getPeerPostBySeq(onion, p.Seq)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = m.db.Exec(
+		`insert or replace into PendingStub (
+			onion,
+			seq,
+			id,
+			prev,
+			hash
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?
+		)`,
+		onion,
+		p.Seq,
+		p.ID,
+		p.Prev,
+		p.Redacted,
+	)
+	if err != nil {
+		return err
+	}
+	err = m.promoteStub(onion, p.Seq)
+	if err != nil {
+		return err
+	}
+	return m.advanceFeed(onion, 0)
+}
+
+// Return pending stub of peer at onion by feed log position.
+func (m *Model) getPendingStub(onion string, seq int64) (*Post, error) {
+	p := &Post{
+		Seq:         seq,
+		Attachments: make([]string, 0),
+		Sealed:      []byte{},
+		Key:         []byte{},
+		Signature:   []byte{},
+		Deleted:     true,
+	}
+	row := m.db.QueryRow(`
+		select
+			id,
+			prev,
+			hash
+		from PendingStub
+		where onion = ? and seq = ?
+	`, onion, seq)
+	err := row.Scan(
+		&p.ID,
+		&p.Prev,
+		&p.hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.Redacted = p.hash
+	return p, nil
+}
+
+// Store pending stub of peer at onion if the cached signed entry after it
+// references its hash.
+func (m *Model) promoteStub(onion string, seq int64) error {
+	stub, err := m.getPendingStub(onion, seq)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	next, err := m.getPeerPostBySeq(onion, seq+1)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if next.Deleted || next.Prev != stub.hash {
+		return nil
+	}
+	values, err := postValues(stub, stub.Key)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.Exec(`
+		insert or ignore into PeerPost (onion, `+postColumns+`)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, append([]interface{}{onion}, values...)...)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.Exec(
+		`delete from PendingStub where onion = ? and seq = ?`,
+		onion,
+		seq,
+	)
+	return err
+}
+
+// Skip a run of deleted entries after the verified position of a feed log.
+// Only the last stub of a run is authenticated (by the signed entry after
+// it), so the run is accepted if the pending stubs link up to it. Returns
+// false if there is no such run.
+func (m *Model) skipStubs(fs *FeedState) (bool, error) {
+	hash := fs.Hash
+	for seq := fs.Seq + 1; ; seq++ {
+		next, err := m.getPeerPostBySeq(fs.Onion, seq)
+		if err == nil {
+			if !next.Deleted || seq == fs.Seq+1 || next.Prev != hash {
+				return false, nil
+			}
+			fs.Seq = next.Seq
+			fs.Hash = next.hash
+			return true, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		stub, err := m.getPendingStub(fs.Onion, seq)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if stub.Prev != hash {
+			return false, nil
+		}
+		hash = stub.hash
+	}
+}
+
+// Record feed log error at seq for peer and return it.
+func (m *Model) feedError(onion string, seq int64, msg string) error {
+	fs, err := m.GetFeedState(onion)
+	if err != nil {
+		return err
+	}
+	fs.Error = msg
+	fs.ErrorSeq = seq
+	err = fs.Insert(m)
+	if err != nil {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// Advance verified feed log position of peer over contiguous cached entries
+// given that an intact entry was received at seq (zero if none). A fork or
+// tampering error is kept until an intact entry is received at its position.
+func (m *Model) advanceFeed(onion string, seq int64) error {
+	fs, err := m.GetFeedState(onion)
+	if err != nil {
+		return err
+	}
+	if fs.ErrorSeq == 0 || fs.ErrorSeq == seq {
+		fs.Error = ""
+		fs.ErrorSeq = 0
+	}
+	for {
+		next, err := m.getPeerPostBySeq(onion, fs.Seq+1)
+		if err == sql.ErrNoRows {
+			skipped, err := m.skipStubs(fs)
+			if err != nil {
+				return err
+			}
+			if !skipped {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if next.Prev != fs.Hash {
+			if fs.ErrorSeq == 0 {
+				fs.Error = fmt.Sprintf("broken chain at seq %d", next.Seq)
+			}
+			break
+		}
+		fs.Seq = next.Seq
+		fs.Hash = next.hash
+	}
+	// Cached entries beyond the verified position mean a gap
+	if len(fs.Error) == 0 {
+		var count int
+		row := m.db.QueryRow(
+			`select count(*) from PeerPost where onion = ? and seq > ?`,
+			onion,
+			fs.Seq,
+		)
+		err = row.Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			fs.Error = fmt.Sprintf("gap after seq %d", fs.Seq)
+		}
+	}
+	_, err = m.db.Exec(
+		`delete from PendingStub where onion = ? and seq <= ?`,
+		onion,
+		fs.Seq,
+	)
+	if err != nil {
+		return err
+	}
+	return fs.Insert(m)
+}
+
+// Return cached post of peer at onion by feed log position.
+func (m *Model) getPeerPostBySeq(onion string, seq int64) (*Post, error) {
+	row := m.db.QueryRow(`
+		select `+postColumns+`
+		from PeerPost
+		where onion = ? and seq = ?
+	`, onion, seq)
+	return scanPost(row)
+}
+
+// Return cached post of peer at onion by id.
+func (m *Model) getPeerPost(onion string, id int64) (*Post, error) {
+	row := m.db.QueryRow(`
+		select `+postColumns+`
+		from PeerPost
+		where onion = ? and id = ?
+	`, onion, id)
+	return scanPost(row)
+}
+
+// Return true if a cached tombstone of peer at onion deletes post id.
+func (m *Model) isTombstoned(onion string, id int64) bool {
+	var count int
+	row := m.db.QueryRow(
+		`select count(*) from PeerPost where onion = ? and type = ? and target = ?`,
+		onion,
+		PostTypeDelete,
+		id,
+	)
+	err := row.Scan(&count)
+	return err == nil && count > 0
+}
+
+// Return true if post of peer at onion is cached.
+func (m *Model) hasPeerPost(onion string, id int64) bool {
+	var count int
+	row := m.db.QueryRow(
+		`select count(*) from PeerPost where onion = ? and id = ?`,
+		onion,
+		id,
+	)
+	err := row.Scan(&count)
+	return err == nil && count > 0
+}
+
+// Return true if post is shown in the timeline by itself (deleted posts
+// and tombstones are hidden, revisions replace the post they edit).
+func (p *Post) onTimeline() bool {
+	return !p.Deleted && p.Type != PostTypeDelete && p.Revises == 0
+}
+
+// TimelineQuery selects posts of the timeline.
+type TimelineQuery struct {
+	Limit int
+	// Only posts tagged with Tag (empty for all posts)
+	Tag string
+	// Only posts by members of list (zero for all posts)
+	List int64
+}
+
+// Return own and cached peer posts merged (newest first). Posts of muted or
+// blocked peers and peer posts matching keyword or regex rules are hidden.
+func (m *Model) GetTimeline(q *TimelineQuery) ([]*TimelinePost, error) {
+	filter, err := m.getContentFilter()
+	if err != nil {
+		return nil, err
+	}
+	self := m.selfOnion()
+	posts := make([]*TimelinePost, 0, q.Limit)
+	// Read pages until enough posts pass the content filter
+	for offset := 0; len(posts) < q.Limit; offset += q.Limit {
+		rows, err := m.db.Query(`
+			select * from (`+allPostsQuery+`)
+			where deleted = 0 and type != 'delete' and revises = 0 and (? = '' or exists (
+				select 1 from Tag
+				where Tag.onion = author and Tag.post = id and Tag.tag = ?
+			)) and (? = 0 or author in (
+				select onion from ListMember where list = ?
+			)) and author not in (
+				select value from Rule where kind in (?, ?)
+			)
+			order by created desc, id desc
+			limit ? offset ?
+		`, q.Tag, q.Tag, q.List, q.List, RuleMute, RuleBlock, q.Limit, offset)
+		if err != nil {
+			return nil, err
+		}
+		page, err := scanTimelinePosts(rows)
+		if err != nil {
+			return nil, err
+		}
+		err = m.applyRevisions(page)
+		if err != nil {
+			return nil, err
+		}
+		for _, tp := range page {
+			if tp.Onion != self && filter.match(tp.Post) {
+				continue
+			}
+			if len(posts) < q.Limit {
+				posts = append(posts, tp)
+			}
+		}
+		if len(page) < q.Limit {
+			break
+		}
+	}
+	err = m.countReplies(posts)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// Replace edited posts with their latest revision.
+func (m *Model) applyRevisions(posts []*TimelinePost) error {
+	rows, err := m.db.Query(`
+		select (select onion from Self), ` + postColumns + `
+		from Post
+		where deleted = 0 and revises != 0
+		union all
+		select onion, ` + postColumns + `
+		from PeerPost
+		where deleted = 0 and revises != 0
+		order by seq
+	`)
+	if err != nil {
+		return err
+	}
+	revisions, err := scanTimelinePosts(rows)
+	if err != nil {
+		return err
+	}
+	latest := make(map[string]*Post)
+	for _, r := range revisions {
+		latest[r.Onion+":"+strconv.FormatInt(r.Revises, 10)] = r.Post
+	}
+	for _, tp := range posts {
+		r, ok := latest[tp.Onion+":"+strconv.FormatInt(tp.ID, 10)]
+		if ok {
+			r.Edited = true
+			tp.Post = r
+		}
+	}
+	return nil
+}
+
+// Scan timeline posts from rows (closing them).
+func scanTimelinePosts(rows *sql.Rows) ([]*TimelinePost, error) {
+	defer rows.Close()
+	posts := make([]*TimelinePost, 0)
+	for rows.Next() {
+		tp := &TimelinePost{}
+		p, err := scanPost(rows, &tp.Onion)
+		if err != nil {
+			return nil, err
+		}
+		tp.Post = p
+		posts = append(posts, tp)
+	}
+	return posts, nil
+}
+
+// Return cached original post of peer and all of its revisions (oldest
+// first).
+func (m *Model) GetPeerRevisions(onion string, id int64) ([]*Post, error) {
+	return m.queryPosts(`
+		select `+postColumns+`
+		from PeerPost
+		where onion = ? and (id = ? or revises = ?) and type != ?
+		order by seq
+	`, onion, id, id, PostTypeDelete)
+}
+
+// Fetch new entries of followed peer's feed log (authenticated), resuming
+// from the last verified position. Returns the number of entries stored.
+func (s *Self) SyncPeer(c *tor.PeerClient, peer *Peer) (int, error) {
+	fs, err := s.model.GetFeedState(peer.Onion)
+	if err != nil {
+		return 0, err
+	}
+	addr := "http://" + peer.Onion + ".onion/?since=" + strconv.FormatInt(fs.Seq, 10)
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return 0, err
+	}
+	s.AuthRequest(req, peer, nil)
+	posts := make([]*Post, 0)
+	err = s.model.cachedGet(c, req, maxFeedSize, &posts)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, p := range posts {
+		err = s.ReceivePost(peer, p)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	fs, err = s.model.GetFeedState(peer.Onion)
+	if err != nil {
+		return count, err
+	}
+	if len(fs.Error) > 0 {
+		return count, errors.New(fs.Error)
+	}
+	return count, nil
+}
+
+// Queue signed post for push delivery to every follower's inbox.
+func (s *Self) pushPost(p *Post) error {
+	followers, err := s.model.GetFollowers()
+	if err != nil {
+		return err
+	}
+	for _, follower := range followers {
+		o := &Outbox{
+			Onion: follower.Onion,
+			Path:  "/inbox/post",
+			Body:  []byte{},
+			Kind:  OutboxPost,
+			Ref:   p.ID,
+		}
+		err = o.Insert(s.model)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
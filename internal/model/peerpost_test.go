@@ -0,0 +1,361 @@
+package model
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Return model in a temporary database with a new self.
+func newTestSelf(t *testing.T) (*Model, *Self) {
+	t.Helper()
+	m, err := NewModel(filepath.Join(t.TempDir(), "pub.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.CreateSelf("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.GetSelf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, s
+}
+
+// Store a and b as peers of each other with a following b. Returns b as
+// known to a and a as known to b.
+func testFollow(t *testing.T, am *Model, a *Self, bm *Model, b *Self) (*Peer, *Peer) {
+	t.Helper()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	pa := a.Peer
+	pa.SecretAuthKey = secret
+	pa.Follower = true
+	pb := b.Peer
+	pb.SecretAuthKey = secret
+	pb.Following = true
+	err := pb.Insert(am)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pa.Insert(bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pb, &pa
+}
+
+// Publish posts with bodies and return the feed log of s as served to
+// anonymous readers (indexed by seq).
+func testFeed(t *testing.T, s *Self, bodies ...string) map[int64]*Post {
+	t.Helper()
+	for _, body := range bodies {
+		err := s.Publish(&Post{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	posts, err := s.model.GetPostsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := make(map[int64]*Post)
+	for _, p := range posts {
+		feed[p.Seq] = copyPost(t, s.PublicPost(p, nil))
+	}
+	return feed
+}
+
+// Return copy of post as received over the wire.
+func copyPost(t *testing.T, p *Post) *Post {
+	t.Helper()
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Post{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Return seqs of cached posts of peer at onion.
+func cachedSeqs(t *testing.T, m *Model, onion string) []int64 {
+	t.Helper()
+	rows, err := m.db.Query(`select seq from PeerPost where onion = ? order by seq`, onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	seqs := make([]int64, 0)
+	for rows.Next() {
+		var seq int64
+		err = rows.Scan(&seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// Feed entry received in a test: the original entry at seq or a variant of it.
+type testEntry struct {
+	seq int64
+	// "fork" (signed by the author but different), "tamper" (bad signature),
+	// "forge" (stub with a hash that isn't the deleted entry's)
+	kind string
+}
+
+// Return entry of feed by author as described by e.
+func (e testEntry) post(t *testing.T, author *Self, feed map[int64]*Post) *Post {
+	t.Helper()
+	p := copyPost(t, feed[e.seq])
+	switch e.kind {
+	case "fork":
+		p.Body = "forked"
+		p.Signature = author.Sign(p.SignedData(author.Onion))
+	case "tamper":
+		p.Body = "tampered"
+	case "forge":
+		p.Redacted = "forged"
+	}
+	return p
+}
+
+func TestReceivePostFeedLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		receive []testEntry
+		seq     int64
+		err     string
+		cached  []int64
+	}{
+		{
+			name:    "in order",
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 3}},
+			seq:     3,
+			cached:  []int64{1, 2, 3},
+		},
+		{
+			name:    "received again",
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 1}, {seq: 2}},
+			seq:     2,
+			cached:  []int64{1, 2},
+		},
+		{
+			name:    "gap",
+			receive: []testEntry{{seq: 1}, {seq: 3}},
+			seq:     1,
+			err:     "gap after seq 1",
+			cached:  []int64{1, 3},
+		},
+		{
+			name:    "gap filled",
+			receive: []testEntry{{seq: 1}, {seq: 3}, {seq: 2}},
+			seq:     3,
+			cached:  []int64{1, 2, 3},
+		},
+		{
+			name:    "fork",
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 2, kind: "fork"}},
+			seq:     2,
+			err:     "fork at seq 2",
+			cached:  []int64{1, 2},
+		},
+		{
+			name:    "fork kept after next entry",
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 2, kind: "fork"}, {seq: 3}},
+			seq:     3,
+			err:     "fork at seq 2",
+			cached:  []int64{1, 2, 3},
+		},
+		{
+			name:    "fork resolved",
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 2, kind: "fork"}, {seq: 2}},
+			seq:     2,
+			cached:  []int64{1, 2},
+		},
+		{
+			name:    "tampered",
+			receive: []testEntry{{seq: 1}, {seq: 2, kind: "tamper"}},
+			seq:     1,
+			err:     "bad signature at seq 2",
+			cached:  []int64{1},
+		},
+		{
+			name:    "tampered kept after next entry",
+			receive: []testEntry{{seq: 1}, {seq: 2, kind: "tamper"}, {seq: 3}},
+			seq:     1,
+			err:     "bad signature at seq 2",
+			cached:  []int64{1, 3},
+		},
+		{
+			name:    "tampered resolved",
+			receive: []testEntry{{seq: 1}, {seq: 2, kind: "tamper"}, {seq: 2}, {seq: 3}},
+			seq:     3,
+			cached:  []int64{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am, a := newTestSelf(t)
+			bm, b := newTestSelf(t)
+			peer, _ := testFollow(t, am, a, bm, b)
+			feed := testFeed(t, b, "one", "two", "three")
+			for _, e := range tt.receive {
+				a.ReceivePost(peer, e.post(t, b, feed))
+			}
+			fs, err := am.GetFeedState(b.Onion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fs.Seq != tt.seq || fs.Error != tt.err {
+				t.Errorf("got seq %d error %q, want seq %d error %q", fs.Seq, fs.Error, tt.seq, tt.err)
+			}
+			if fs.Seq > 0 && fs.Hash != feed[fs.Seq].Hash(b.Onion) {
+				t.Errorf("feed state hash doesn't match entry at seq %d", fs.Seq)
+			}
+			cached := cachedSeqs(t, am, b.Onion)
+			if !reflect.DeepEqual(cached, tt.cached) {
+				t.Errorf("got cached %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
+
+func TestReceivePostStubs(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted []int64
+		receive []testEntry
+		seq     int64
+		err     string
+		cached  []int64
+	}{
+		{
+			name:    "stub authenticated by next entry",
+			deleted: []int64{2},
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 3}, {seq: 4}},
+			seq:     4,
+			cached:  []int64{1, 2, 3, 4},
+		},
+		{
+			name:    "stub before next entry",
+			deleted: []int64{2},
+			receive: []testEntry{{seq: 2}, {seq: 3}, {seq: 1}, {seq: 4}},
+			seq:     4,
+			cached:  []int64{1, 2, 3, 4},
+		},
+		{
+			name:    "stub pending at head",
+			deleted: []int64{2},
+			receive: []testEntry{{seq: 1}, {seq: 2}},
+			seq:     1,
+			cached:  []int64{1},
+		},
+		{
+			// Only the last stub of a run is authenticated by a signed entry,
+			// earlier ones are bridged without being cached
+			name:    "consecutive stubs",
+			deleted: []int64{2, 3},
+			receive: []testEntry{{seq: 1}, {seq: 2}, {seq: 3}, {seq: 4}, {seq: 5}},
+			seq:     5,
+			cached:  []int64{1, 3, 4, 5},
+		},
+		{
+			name:    "forged stub",
+			deleted: []int64{2},
+			receive: []testEntry{{seq: 1}, {seq: 2, kind: "forge"}, {seq: 3}},
+			seq:     1,
+			err:     "gap after seq 1",
+			cached:  []int64{1, 3},
+		},
+		{
+			name:    "forged stub replaced",
+			deleted: []int64{2},
+			receive: []testEntry{{seq: 1}, {seq: 2, kind: "forge"}, {seq: 3}, {seq: 2}},
+			seq:     3,
+			cached:  []int64{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am, a := newTestSelf(t)
+			bm, b := newTestSelf(t)
+			peer, _ := testFollow(t, am, a, bm, b)
+			testFeed(t, b, "one", "two", "three")
+			// Deleting appends tombstones from seq 4 on and turns the deleted
+			// entries into stubs
+			for _, id := range tt.deleted {
+				_, err := b.Delete(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			feed := testFeed(t, b)
+			for _, e := range tt.receive {
+				a.ReceivePost(peer, e.post(t, b, feed))
+			}
+			fs, err := am.GetFeedState(b.Onion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fs.Seq != tt.seq || fs.Error != tt.err {
+				t.Errorf("got seq %d error %q, want seq %d error %q", fs.Seq, fs.Error, tt.seq, tt.err)
+			}
+			cached := cachedSeqs(t, am, b.Onion)
+			if !reflect.DeepEqual(cached, tt.cached) {
+				t.Errorf("got cached %v, want %v", cached, tt.cached)
+			}
+			// Stubs are cached as deleted entries only
+			for _, seq := range cached {
+				p, err := am.getPeerPostBySeq(b.Onion, seq)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Deleted != feed[seq].Deleted || (p.Deleted && p.hash != feed[seq].Redacted) {
+					t.Errorf("cached entry at seq %d doesn't match feed", seq)
+				}
+			}
+		})
+	}
+}
+
+func TestReceivePostEvents(t *testing.T) {
+	am, a := newTestSelf(t)
+	bm, b := newTestSelf(t)
+	peer, _ := testFollow(t, am, a, bm, b)
+	events := am.Subscribe()
+	defer am.Unsubscribe(events)
+	// Entries are received as they are published, before being redacted
+	changes := []func() error{
+		func() error { return b.Publish(&Post{Body: "one"}) },
+		func() error { return b.Edit(1, &Post{Body: "two"}) },
+		func() error { _, err := b.Delete(1); return err },
+	}
+	for i, change := range changes {
+		err := change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed := testFeed(t, b)
+		err = a.ReceivePost(peer, feed[int64(i+1)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	kinds := make([]string, 0)
+	for len(events) > 0 {
+		e := <-events
+		kinds = append(kinds, e.Kind)
+	}
+	want := []string{EventPost, EventUpdate, EventUpdate}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got events %v, want %v", kinds, want)
+	}
+}
@@ -0,0 +1,768 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/wybiral/pub/pkg/markdown"
+	"golang.org/x/crypto/nacl/secretbox"
+	"log"
+	"time"
+)
+
+// Post content types.
+const (
+	PostTypeText     = "text"
+	PostTypeMarkdown = "markdown"
+	// Signed tombstone deleting Target
+	PostTypeDelete = "delete"
+	// Entry embedding a signed post of another author
+	PostTypeRepost = "repost"
+)
+
+// Post visibility settings.
+const (
+	VisibilityPublic      = "public"
+	VisibilitySubscribers = "subscribers"
+)
+
+// Columns shared by Post and PeerPost (in scanPost order).
+const postColumns = `
+	id,
+	seq,
+	prev,
+	hash,
+	type,
+	visibility,
+	body,
+	attachments,
+	target,
+	revises,
+	sealed,
+	key,
+	created,
+	signature,
+	deleted,
+	reply_onion,
+	reply_id,
+	reply_hash,
+	repost,
+	tags,
+	mentions
+`
+
+const postSchema = `
+create table if not exists Post (
+	id integer primary key autoincrement,
+	seq integer not null unique,
+	prev string not null,
+	hash string not null,
+	type string not null,
+	visibility string not null,
+	body string not null,
+	attachments string not null,
+	target integer not null,
+	revises integer not null,
+	sealed blob not null,
+	key blob not null,
+	created integer not null,
+	signature blob not null,
+	deleted integer not null,
+	reply_onion string not null,
+	reply_id integer not null,
+	reply_hash string not null,
+	repost string not null,
+	tags string not null,
+	mentions string not null
+);
+`
+
+type Post struct {
+	ID int64 `json:"id"`
+	// Position in the author's feed log
+	Seq int64 `json:"seq"`
+	// Hash of the previous entry in the author's feed log
+	Prev        string   `json:"prev"`
+	Type        string   `json:"type"`
+	Visibility  string   `json:"visibility"`
+	Body        string   `json:"body"`
+	HTML        string   `json:"html,omitempty"`
+	Attachments []string `json:"attachments"`
+	// Explicit tags (hashtags in the body are tagged automatically)
+	Tags []string `json:"tags,omitempty"`
+	// Onions of peers mentioned in the body (resolved when publishing)
+	Mentions []string `json:"mentions,omitempty"`
+	// Id of post deleted by a tombstone
+	Target int64 `json:"target,omitempty"`
+	// Id of original post edited by a revision
+	Revises int64 `json:"revises,omitempty"`
+	// Post (possibly on another node) this post replies to
+	ReplyTo *PostRef `json:"reply_to,omitempty"`
+	// Embedded original of repost entries
+	Repost *Repost `json:"repost,omitempty"`
+	// Reaction counts per emoji (added by the author's node when serving)
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// Set on the latest revision as served in place of an edited post
+	Edited bool `json:"edited,omitempty"`
+	// Deleted posts are served as stubs carrying only their entry hash,
+	// which is authenticated by the prev hash of the next signed entry
+	Deleted  bool   `json:"deleted,omitempty"`
+	Redacted string `json:"redacted,omitempty"`
+	// Encrypted body and attachments of subscribers-only posts
+	Sealed []byte `json:"sealed,omitempty"`
+	// Post key wrapped for the reader of subscribers-only posts
+	Key       []byte `json:"key,omitempty"`
+	Created   int64  `json:"created"`
+	Signature []byte `json:"sig"`
+	// Plain post key (only known to author)
+	postKey []byte
+	// Hash of this entry (computed locally)
+	hash string
+}
+
+// PostRef references a signed feed entry of any author.
+type PostRef struct {
+	Onion string `json:"onion"`
+	// Id of the original post (revisions are referenced by the post they edit)
+	ID int64 `json:"id"`
+	// Hash of the referenced entry as seen by the replying author
+	Hash string `json:"hash"`
+}
+
+// Signed portion of a post.
+type postContent struct {
+	Onion       string   `json:"onion"`
+	ID          int64    `json:"id"`
+	Seq         int64    `json:"seq"`
+	Prev        string   `json:"prev"`
+	Type        string   `json:"type"`
+	Visibility  string   `json:"visibility"`
+	Body        string   `json:"body"`
+	Attachments []string `json:"attachments"`
+	Tags        []string `json:"tags,omitempty"`
+	Mentions    []string `json:"mentions,omitempty"`
+	Target      int64    `json:"target,omitempty"`
+	Revises     int64    `json:"revises,omitempty"`
+	ReplyTo     *PostRef `json:"reply_to,omitempty"`
+	Repost      *Repost  `json:"repost,omitempty"`
+	Sealed      []byte   `json:"sealed,omitempty"`
+	Created     int64    `json:"created"`
+}
+
+// Encrypted portion of a subscribers-only post.
+type sealedContent struct {
+	Body        string   `json:"body"`
+	Attachments []string `json:"attachments"`
+	Tags        []string `json:"tags,omitempty"`
+	Mentions    []string `json:"mentions,omitempty"`
+	ReplyTo     *PostRef `json:"reply_to,omitempty"`
+}
+
+// Return bytes covered by the post signature for author onion.
+// Subscribers-only posts are signed over their sealed content so that
+// signatures can be verified without the post key.
+func (p *Post) SignedData(onion string) []byte {
+	c := postContent{
+		Onion:       onion,
+		ID:          p.ID,
+		Seq:         p.Seq,
+		Prev:        p.Prev,
+		Type:        p.Type,
+		Visibility:  p.Visibility,
+		Body:        p.Body,
+		Attachments: p.Attachments,
+		Tags:        p.Tags,
+		Mentions:    p.Mentions,
+		Target:      p.Target,
+		Revises:     p.Revises,
+		ReplyTo:     p.ReplyTo,
+		Sealed:      p.Sealed,
+		Created:     p.Created,
+	}
+	if p.Repost != nil {
+		c.Repost = p.Repost.signed()
+	}
+	if p.Visibility == VisibilitySubscribers {
+		c.Body = ""
+		c.Attachments = make([]string, 0)
+		c.Tags = nil
+		c.Mentions = nil
+		c.ReplyTo = nil
+	}
+	data, _ := json.Marshal(c)
+	return data
+}
+
+// Return hash of signed post entry as referenced by the next entry.
+func (p *Post) Hash(onion string) string {
+	sum := sha256.Sum256(p.SignedData(onion))
+	return hex.EncodeToString(sum[:])
+}
+
+// Render HTML for Markdown posts (rendered locally, never trusted from peers).
+func (p *Post) Render() {
+	if p.Type == PostTypeMarkdown {
+		p.HTML = markdown.Render(p.Body)
+	} else {
+		p.HTML = ""
+	}
+}
+
+// Verify post signature against author peer.
+func (p *Post) Verify(author *Peer) bool {
+	return author.Verify(p.SignedData(author.Onion), p.Signature)
+}
+
+// Return array of all posts (newest first).
+func (m *Model) GetPosts() ([]*Post, error) {
+	return m.queryPosts(`
+		select ` + postColumns + `
+		from Post
+		order by seq desc
+	`)
+}
+
+// Return published posts (newest first) for reading, with edited posts
+// replaced by their latest signed revision. Only public tags match tag
+// (empty for all posts).
+func (m *Model) GetFeed(tag string) ([]*Post, error) {
+	posts, err := m.queryPosts(`
+		select `+postColumns+`
+		from Post
+		where deleted = 0 and type != ? and revises = 0 and (? = '' or id in (
+			select post from Tag
+			where onion = (select onion from Self) and tag = ? and public = 1
+		))
+		order by seq desc
+	`, PostTypeDelete, tag, tag)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := m.queryPosts(`
+		select ` + postColumns + `
+		from Post
+		where deleted = 0 and revises != 0
+		order by seq
+	`)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[int64]*Post)
+	for _, r := range revisions {
+		latest[r.Revises] = r
+	}
+	for i, p := range posts {
+		r, ok := latest[p.ID]
+		if ok {
+			r.Edited = true
+			posts[i] = r
+		}
+	}
+	return posts, nil
+}
+
+// Return original post and all of its revisions (oldest first).
+func (m *Model) GetRevisions(id int64) ([]*Post, error) {
+	return m.queryPosts(`
+		select `+postColumns+`
+		from Post
+		where (id = ? or revises = ?) and type != ?
+		order by seq
+	`, id, id, PostTypeDelete)
+}
+
+// Return posts after feed log position seq (oldest first).
+func (m *Model) GetPostsSince(seq int64) ([]*Post, error) {
+	return m.queryPosts(`
+		select `+postColumns+`
+		from Post
+		where seq > ?
+		order by seq
+	`, seq)
+}
+
+// Return post by id.
+func (m *Model) GetPost(id int64) (*Post, error) {
+	row := m.db.QueryRow(`
+		select `+postColumns+`
+		from Post
+		where id = ?
+	`, id)
+	return scanPost(row)
+}
+
+// Return array of posts from query.
+func (m *Model) queryPosts(query string, args ...interface{}) ([]*Post, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	posts := make([]*Post, 0)
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan post from row (after any extra leading columns).
+func scanPost(row scanner, extra ...interface{}) (*Post, error) {
+	p := &Post{}
+	var attachments string
+	var repost string
+	var tags string
+	var mentions string
+	ref := &PostRef{}
+	dest := append(extra,
+		&p.ID,
+		&p.Seq,
+		&p.Prev,
+		&p.hash,
+		&p.Type,
+		&p.Visibility,
+		&p.Body,
+		&attachments,
+		&p.Target,
+		&p.Revises,
+		&p.Sealed,
+		&p.postKey,
+		&p.Created,
+		&p.Signature,
+		&p.Deleted,
+		&ref.Onion,
+		&ref.ID,
+		&ref.Hash,
+		&repost,
+		&tags,
+		&mentions,
+	)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(attachments), &p.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(tags), &p.Tags)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(mentions), &p.Mentions)
+	if err != nil {
+		return nil, err
+	}
+	if len(ref.Onion) > 0 {
+		p.ReplyTo = ref
+	}
+	if len(repost) > 0 {
+		p.Repost = &Repost{}
+		err = json.Unmarshal([]byte(repost), p.Repost)
+		if err != nil {
+			return nil, err
+		}
+		p.Repost.open()
+	}
+	if p.Deleted {
+		p.Redacted = p.hash
+	}
+	p.Render()
+	return p, nil
+}
+
+// Return column values of post (in postColumns order).
+func postValues(p *Post, key []byte) ([]interface{}, error) {
+	encoded, err := json.Marshal(p.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	tags := p.Tags
+	if tags == nil {
+		tags = make([]string, 0)
+	}
+	encodedTags, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
+	mentions := p.Mentions
+	if mentions == nil {
+		mentions = make([]string, 0)
+	}
+	encodedMentions, err := json.Marshal(mentions)
+	if err != nil {
+		return nil, err
+	}
+	ref := p.ReplyTo
+	if ref == nil {
+		ref = &PostRef{}
+	}
+	repost := ""
+	if p.Repost != nil {
+		stored := p.Repost.signed()
+		stored.Verified = p.Repost.Verified
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return nil, err
+		}
+		repost = string(data)
+	}
+	return []interface{}{
+		p.ID,
+		p.Seq,
+		p.Prev,
+		p.hash,
+		p.Type,
+		p.Visibility,
+		p.Body,
+		string(encoded),
+		p.Target,
+		p.Revises,
+		p.Sealed,
+		key,
+		p.Created,
+		p.Signature,
+		p.Deleted,
+		ref.Onion,
+		ref.ID,
+		ref.Hash,
+		repost,
+		string(encodedTags),
+		string(encodedMentions),
+	}, nil
+}
+
+// Return own post as served to reader (reader is nil when anonymous).
+// Subscribers-only posts are stripped of their plain content and only carry
+// the post key, wrapped for the reader, if the reader is a follower.
+func (s *Self) PublicPost(p *Post, reader *Peer) *Post {
+	if p.Deleted {
+		return p.stub()
+	}
+	if p.Visibility != VisibilitySubscribers {
+		return p
+	}
+	public := *p
+	public.Body = ""
+	public.HTML = ""
+	public.Attachments = make([]string, 0)
+	public.Tags = nil
+	public.Mentions = nil
+	public.ReplyTo = nil
+	public.Key = nil
+	public.postKey = nil
+	if reader != nil && reader.Follower {
+		public.Key = s.SealFor(reader, p.postKey)
+	}
+	return &public
+}
+
+// Return stub of deleted post that keeps its place in the feed log.
+func (p *Post) stub() *Post {
+	return &Post{
+		ID:          p.ID,
+		Seq:         p.Seq,
+		Prev:        p.Prev,
+		Attachments: make([]string, 0),
+		Deleted:     true,
+		Redacted:    p.hash,
+		hash:        p.hash,
+	}
+}
+
+// Decrypt subscribers-only post from author using the wrapped post key.
+func (s *Self) OpenPost(author *Peer, p *Post) error {
+	if p.Visibility != VisibilitySubscribers {
+		return nil
+	}
+	if len(p.Key) < 24 || len(p.Sealed) < 24 {
+		return errors.New("no post key")
+	}
+	key, ok := s.OpenFrom(author, p.Key)
+	if !ok || len(key) != 32 {
+		return errors.New("box not opened")
+	}
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], key)
+	copy(nonce[:], p.Sealed[:24])
+	opened, ok := secretbox.Open(nil, p.Sealed[24:], &nonce, &secretKey)
+	if !ok {
+		return errors.New("box not opened")
+	}
+	content := sealedContent{}
+	err := json.Unmarshal(opened, &content)
+	if err != nil {
+		return err
+	}
+	p.Body = content.Body
+	p.Attachments = content.Attachments
+	p.Tags = content.Tags
+	p.Mentions = content.Mentions
+	p.ReplyTo = content.ReplyTo
+	p.Render()
+	return nil
+}
+
+// Seal body and attachments of post with a new random post key.
+func (p *Post) seal() error {
+	var secretKey [32]byte
+	var nonce [24]byte
+	rand.Read(secretKey[:])
+	rand.Read(nonce[:])
+	data, err := json.Marshal(sealedContent{
+		Body:        p.Body,
+		Attachments: p.Attachments,
+		Tags:        p.Tags,
+		Mentions:    p.Mentions,
+		ReplyTo:     p.ReplyTo,
+	})
+	if err != nil {
+		return err
+	}
+	p.Sealed = secretbox.Seal(nonce[:], data, &nonce, &secretKey)
+	p.postKey = secretKey[:]
+	return nil
+}
+
+// Apply defaults to user supplied post fields and validate them.
+func (p *Post) normalize() error {
+	if len(p.Type) == 0 {
+		p.Type = PostTypeText
+	}
+	if p.Type != PostTypeText && p.Type != PostTypeMarkdown {
+		return errors.New("bad content type")
+	}
+	if len(p.Visibility) == 0 {
+		p.Visibility = VisibilityPublic
+	}
+	if p.Visibility != VisibilityPublic && p.Visibility != VisibilitySubscribers {
+		return errors.New("bad visibility")
+	}
+	if p.Attachments == nil {
+		p.Attachments = make([]string, 0)
+	}
+	tags, err := normalizeTags(p.Tags)
+	if err != nil {
+		return err
+	}
+	p.Tags = tags
+	return nil
+}
+
+// Publish post as a new signed entry appended to our feed log (fills in id,
+// seq, prev, created and signature).
+func (s *Self) Publish(p *Post) error {
+	err := p.normalize()
+	if err != nil {
+		return err
+	}
+	// Attachments must reference local blobs
+	for _, hash := range p.Attachments {
+		ok, err := s.model.HasBlob(hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("blob not found")
+		}
+	}
+	// Revisions keep the reference of the original post
+	if p.ReplyTo != nil && p.Revises == 0 {
+		p.ReplyTo, err = s.model.resolveRef(p.ReplyTo.Onion, p.ReplyTo.ID)
+		if err != nil {
+			return err
+		}
+	}
+	p.Mentions, err = s.model.resolveMentions(p.Body)
+	if err != nil {
+		return err
+	}
+	p.Sealed = []byte{}
+	p.postKey = []byte{}
+	if p.Visibility == VisibilitySubscribers {
+		err = p.seal()
+		if err != nil {
+			return err
+		}
+	}
+	return s.appendEntry(p)
+}
+
+// Sign entry and append it to our feed log, then queue it for followers.
+func (s *Self) appendEntry(p *Post) error {
+	p.Created = time.Now().Unix()
+	tx, err := s.model.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Append to feed log after the current head
+	p.Seq = 1
+	p.Prev = ""
+	row := tx.QueryRow(`select seq, hash from Post order by seq desc limit 1`)
+	err = row.Scan(&p.Seq, &p.Prev)
+	if err == nil {
+		p.Seq++
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	p.Signature = []byte{}
+	values, err := postValues(p, p.postKey)
+	if err != nil {
+		return err
+	}
+	// Let the id autoincrement
+	values[0] = nil
+	result, err := tx.Exec(`
+		insert into Post (`+postColumns+`)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, values...)
+	if err != nil {
+		return err
+	}
+	p.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	// Sign once the id is known
+	p.Signature = s.Sign(p.SignedData(s.Onion))
+	p.hash = p.Hash(s.Onion)
+	_, err = tx.Exec(
+		`update Post set signature = ?, hash = ? where id = ?`,
+		p.Signature,
+		p.hash,
+		p.ID,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// The entry is published from here on (followers that miss the push
+	// still get it by polling), so later failures are only logged
+	p.Render()
+	err = s.model.indexPost(s.Onion, p)
+	if err != nil {
+		log.Println("index:", err)
+	}
+	err = s.model.tagPost(s.Onion, p)
+	if err != nil {
+		log.Println("tag:", err)
+	}
+	tp := &TimelinePost{Onion: s.Onion, Post: p}
+	s.model.Emit(EventEntry, tp)
+	if p.onTimeline() {
+		s.model.Emit(EventPost, tp)
+	} else {
+		s.model.Emit(EventUpdate, tp)
+	}
+	err = s.pushPost(p)
+	if err != nil {
+		log.Println("push:", err)
+	}
+	return nil
+}
+
+// Delete own post by publishing a signed tombstone and redacting its content.
+func (s *Self) Delete(id int64) (*Post, error) {
+	p, err := s.model.GetPost(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Deleted || p.Type == PostTypeDelete || p.Revises != 0 {
+		return nil, errors.New("post can't be deleted")
+	}
+	tombstone := &Post{
+		Type:        PostTypeDelete,
+		Visibility:  VisibilityPublic,
+		Attachments: make([]string, 0),
+		Target:      p.ID,
+		Sealed:      []byte{},
+		postKey:     []byte{},
+	}
+	err = s.appendEntry(tombstone)
+	if err != nil {
+		return nil, err
+	}
+	err = s.model.redactPost("Post", "", p)
+	if err != nil {
+		return nil, err
+	}
+	return tombstone, nil
+}
+
+// Purge content of post and its revisions in table (Post or PeerPost) along
+// with blobs that are no longer referenced.
+func (m *Model) redactPost(table, onion string, p *Post) error {
+	where := ` where (id = ? or revises = ?)`
+	args := []interface{}{p.ID, p.ID}
+	if table == "PeerPost" {
+		where += ` and onion = ?`
+		args = append(args, onion)
+	}
+	posts, err := m.queryPosts(`select `+postColumns+` from `+table+where, args...)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.Exec(`
+		update `+table+`
+		set body = '', attachments = '[]', sealed = x'', key = x'', repost = '',
+			tags = '[]', mentions = '[]', deleted = 1
+	`+where, args...)
+	if err != nil {
+		return err
+	}
+	for _, r := range posts {
+		err = m.purgeBlobs(r.Attachments)
+		if err != nil {
+			return err
+		}
+	}
+	if table == "Post" {
+		onion = m.selfOnion()
+	}
+	err = m.untagPost(onion, p.ID)
+	if err != nil {
+		return err
+	}
+	err = m.unindex(SearchPost, onion, p.ID)
+	if err != nil {
+		return err
+	}
+	return m.unindex(SearchRepost, onion, p.ID)
+}
+
+// Edit own post by publishing p as a new signed revision of it.
+func (s *Self) Edit(id int64, p *Post) error {
+	original, err := s.model.GetPost(id)
+	if err != nil {
+		return err
+	}
+	// Revisions always point to the original post
+	if original.Revises != 0 {
+		original, err = s.model.GetPost(original.Revises)
+		if err != nil {
+			return err
+		}
+	}
+	if original.Deleted || original.Type == PostTypeDelete || original.Type == PostTypeRepost {
+		return errors.New("post can't be edited")
+	}
+	p.Revises = original.ID
+	p.Visibility = original.Visibility
+	p.ReplyTo = original.ReplyTo
+	return s.Publish(p)
+}
@@ -0,0 +1,325 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Reaction used for plain likes (any single emoji is accepted too).
+const ReactionLike = "like"
+
+// Maximum length of an emoji reaction in code points.
+const maxReactionLength = 16
+
+// Joiners and modifiers within emoji sequences.
+const (
+	emojiJoiner    = 0x200d
+	emojiVariation = 0xfe0f
+	emojiKeycap    = 0x20e3
+	emojiTagCancel = 0xe007f
+)
+
+const reactionSchema = `
+create table if not exists Reaction (
+	author string not null,
+	post integer not null,
+	onion string not null,
+	emoji string not null,
+	removed integer not null,
+	created integer not null,
+	signature blob not null,
+	primary key (author, post, onion, emoji)
+);
+`
+
+// Reaction event by peer at onion on post of author, signed by the reacting
+// peer. Removing a reaction is a newer event with Removed set.
+type Reaction struct {
+	Author    string `json:"author"`
+	Post      int64  `json:"post"`
+	Onion     string `json:"onion"`
+	Emoji     string `json:"emoji"`
+	Removed   bool   `json:"removed,omitempty"`
+	Created   int64  `json:"created"`
+	Signature []byte `json:"sig"`
+}
+
+// Return bytes covered by the reaction signature.
+func (rc *Reaction) SignedData() []byte {
+	data, _ := json.Marshal(Reaction{
+		Author:  rc.Author,
+		Post:    rc.Post,
+		Onion:   rc.Onion,
+		Emoji:   rc.Emoji,
+		Removed: rc.Removed,
+		Created: rc.Created,
+	})
+	return data
+}
+
+// Insert model into DB (only replaces older events of the same reaction).
+func (rc *Reaction) Insert(m *Model) error {
+	_, err := rc.insert(m)
+	return err
+}
+
+// Insert model into DB and return true if it changed the stored reaction.
+func (rc *Reaction) insert(m *Model) (bool, error) {
+	result, err := m.db.Exec(
+		`insert into Reaction (
+			author,
+			post,
+			onion,
+			emoji,
+			removed,
+			created,
+			signature
+		) values (
+			?,
+			?,
+			?,
+			?,
+			?,
+			?,
+			?
+		) on conflict(author, post, onion, emoji) do update set
+			removed = excluded.removed,
+			created = excluded.created,
+			signature = excluded.signature
+		where excluded.created >= Reaction.created
+			and excluded.signature != Reaction.signature`,
+		rc.Author,
+		rc.Post,
+		rc.Onion,
+		rc.Emoji,
+		rc.Removed,
+		rc.Created,
+		rc.Signature,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Return current reactions on posts of author (newest first), optionally
+// limited to post id (zero for all posts).
+func (m *Model) GetReactions(author string, post int64) ([]*Reaction, error) {
+	rows, err := m.db.Query(`
+		select
+			author,
+			post,
+			onion,
+			emoji,
+			removed,
+			created,
+			signature
+		from Reaction
+		where author = ? and (? = 0 or post = ?) and removed = 0
+		order by created desc
+	`, author, post, post)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reactions := make([]*Reaction, 0)
+	for rows.Next() {
+		rc := &Reaction{}
+		err = rows.Scan(
+			&rc.Author,
+			&rc.Post,
+			&rc.Onion,
+			&rc.Emoji,
+			&rc.Removed,
+			&rc.Created,
+			&rc.Signature,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, rc)
+	}
+	return reactions, nil
+}
+
+// Return reaction counts per emoji for each post of author.
+func (m *Model) GetReactionCounts(author string) (map[int64]map[string]int, error) {
+	rows, err := m.db.Query(`
+		select post, emoji, count(*)
+		from Reaction
+		where author = ? and removed = 0
+		group by post, emoji
+	`, author)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[int64]map[string]int)
+	for rows.Next() {
+		var post int64
+		var emoji string
+		var count int
+		err = rows.Scan(&post, &emoji, &count)
+		if err != nil {
+			return nil, err
+		}
+		if counts[post] == nil {
+			counts[post] = make(map[string]int)
+		}
+		counts[post][emoji] = count
+	}
+	return counts, nil
+}
+
+// Return true if emoji is an acceptable reaction (a like or a single emoji).
+func validReaction(emoji string) bool {
+	if emoji == ReactionLike {
+		return true
+	}
+	n := utf8.RuneCountInString(emoji)
+	if !utf8.ValidString(emoji) || n == 0 || n > maxReactionLength {
+		return false
+	}
+	return singleEmoji([]rune(emoji))
+}
+
+// Return true if runes form one emoji: a flag, a keycap or emoji joined by
+// zero width joiners, each optionally followed by a variation selector or
+// skin tone (and tags for subdivision flags).
+func singleEmoji(runes []rune) bool {
+	if len(runes) == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]) {
+		return true
+	}
+	last := runes[len(runes)-1]
+	if last == emojiKeycap {
+		keys := runes[:len(runes)-1]
+		if len(keys) == 2 && keys[1] == emojiVariation {
+			keys = keys[:1]
+		}
+		return len(keys) == 1 && strings.ContainsRune("0123456789#*", keys[0])
+	}
+	if last == emojiTagCancel {
+		// Black flag followed by tag characters
+		if runes[0] != 0x1f3f4 || len(runes) < 3 {
+			return false
+		}
+		for _, r := range runes[1 : len(runes)-1] {
+			if r < 0xe0020 || r > 0xe007e {
+				return false
+			}
+		}
+		return true
+	}
+	expectEmoji := true
+	for i, r := range runes {
+		switch {
+		case expectEmoji:
+			if !isEmoji(r) {
+				return false
+			}
+			expectEmoji = false
+		case r == emojiJoiner:
+			expectEmoji = true
+		case r == emojiVariation || isSkinTone(r):
+			// Modifiers only follow an emoji
+			if runes[i-1] == emojiVariation || isSkinTone(runes[i-1]) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return !expectEmoji
+}
+
+// Return true if r is an emoji character (pictographs and symbols).
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1f000 && r <= 0x1faff:
+		return !isRegionalIndicator(r) && !isSkinTone(r)
+	case r >= 0x2190 && r <= 0x21ff, r >= 0x2300 && r <= 0x23ff:
+		return true
+	case r >= 0x25a0 && r <= 0x27bf, r >= 0x2900 && r <= 0x297f:
+		return true
+	case r >= 0x2b00 && r <= 0x2bff:
+		return true
+	}
+	return strings.ContainsRune("\u00a9\u00ae\u203c\u2049\u2122\u2139\u3030\u303d\u3297\u3299", r)
+}
+
+// Return true if r is a regional indicator (two form a flag).
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// Return true if r is a skin tone modifier.
+func isSkinTone(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+// Sign reaction to post of followed peer and queue it for delivery.
+func (s *Self) SendReaction(author string, post int64, emoji string, removed bool) (*Reaction, error) {
+	if !validReaction(emoji) {
+		return nil, errors.New("bad reaction")
+	}
+	peer, err := s.model.GetPeer(author)
+	if err != nil || !peer.Following {
+		return nil, errors.New("not following peer")
+	}
+	rc := &Reaction{
+		Author:  author,
+		Post:    post,
+		Onion:   s.Onion,
+		Emoji:   emoji,
+		Removed: removed,
+		Created: time.Now().Unix(),
+	}
+	rc.Signature = s.Sign(rc.SignedData())
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return nil, err
+	}
+	err = rc.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		Onion: peer.Onion,
+		Path:  "/posts/" + strconv.FormatInt(post, 10) + "/reactions",
+		Body:  data,
+		Kind:  OutboxReaction,
+		Ref:   post,
+	}
+	err = o.Insert(s.model)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Verify and store reaction from authenticated follower on own post.
+func (s *Self) ReceiveReaction(peer *Peer, rc *Reaction) error {
+	if !peer.Follower {
+		return errors.New("not a follower")
+	}
+	if rc.Author != s.Onion || rc.Onion != peer.Onion || !validReaction(rc.Emoji) {
+		return errors.New("bad reaction")
+	}
+	if !peer.Verify(rc.SignedData(), rc.Signature) {
+		return errors.New("bad reaction signature")
+	}
+	_, err := s.ReadablePost(rc.Post, peer)
+	if err != nil {
+		return err
+	}
+	changed, err := rc.insert(s.model)
+	if err != nil || !changed || rc.Removed {
+		return err
+	}
+	return s.model.notify(NotifyReaction, peer.Onion, rc.Post, rc.Emoji)
+}
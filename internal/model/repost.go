@@ -0,0 +1,196 @@
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/wybiral/pub/pkg/tor"
+)
+
+// Repost embeds a signed entry of another author so that readers can verify
+// it against that author's sign key without following them.
+type Repost struct {
+	Onion         string `json:"onion"`
+	PublicSignKey []byte `json:"public_sign_key"`
+	// Signed data and signature of the original entry
+	Data []byte `json:"data"`
+	Sig  []byte `json:"sig"`
+	// Original post decoded from Data if the signature verified (not signed)
+	Post *Post `json:"post,omitempty"`
+	// True if PublicSignKey is the key of the original author as known to us
+	// or served at their /info (not signed)
+	Verified bool `json:"verified"`
+}
+
+// Return repost without decoded original (as signed and stored).
+func (r *Repost) signed() *Repost {
+	return &Repost{
+		Onion:         r.Onion,
+		PublicSignKey: r.PublicSignKey,
+		Data:          r.Data,
+		Sig:           r.Sig,
+	}
+}
+
+// Verify embedded entry against the embedded sign key and decode it into
+// Post.
+func (r *Repost) open() error {
+	r.Post = nil
+	author := &Peer{Onion: r.Onion, PublicSignKey: r.PublicSignKey}
+	if !author.Verify(r.Data, r.Sig) {
+		return errors.New("bad repost signature")
+	}
+	c := postContent{}
+	err := json.Unmarshal(r.Data, &c)
+	if err != nil {
+		return err
+	}
+	if c.Onion != r.Onion {
+		return errors.New("bad repost")
+	}
+	p := &Post{
+		ID:          c.ID,
+		Seq:         c.Seq,
+		Prev:        c.Prev,
+		Type:        c.Type,
+		Visibility:  c.Visibility,
+		Body:        c.Body,
+		Attachments: c.Attachments,
+		Revises:     c.Revises,
+		ReplyTo:     c.ReplyTo,
+		Sealed:      c.Sealed,
+		Created:     c.Created,
+		Signature:   r.Sig,
+	}
+	if p.Attachments == nil {
+		p.Attachments = make([]string, 0)
+	}
+	p.Render()
+	r.Post = p
+	return nil
+}
+
+// Verify repost, also checking the embedded sign key against the key of the
+// original author if we know them. Reposts of unknown authors are marked
+// unverified until their key is fetched (see VerifyRepost).
+func (m *Model) checkRepost(r *Repost) error {
+	r.Verified = false
+	known, err := m.GetPeer(r.Onion)
+	if err == nil {
+		if !bytes.Equal(known.PublicSignKey, r.PublicSignKey) {
+			return errors.New("repost author key mismatch")
+		}
+		r.Verified = true
+	}
+	return r.open()
+}
+
+// Mark own and cached reposts of author onion embedding sign key as verified.
+func (m *Model) verifyReposts(onion string, key []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(key)
+	for _, table := range []string{"Post", "PeerPost"} {
+		_, err := m.db.Exec(`
+			update `+table+`
+			set repost = json_set(repost, '$.verified', json('true'))
+			where repost != ''
+			and json_extract(repost, '$.onion') = ?
+			and json_extract(repost, '$.public_sign_key') = ?
+		`, onion, encoded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return own or cached repost id by onion and the original author as served
+// at their /info (after checking their sign key matches the reposted entry).
+func (s *Self) repostAuthor(c *tor.PeerClient, onion string, id int64) (*TimelinePost, *Peer, error) {
+	tp, err := s.model.getAnyPost(onion, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tp.Repost == nil {
+		return nil, nil, errors.New("not a repost")
+	}
+	author, err := s.model.GetPeerByOnion(c, tp.Repost.Onion)
+	if err != nil {
+		return nil, nil, err
+	}
+	if author.Onion != tp.Repost.Onion || !bytes.Equal(author.PublicSignKey, tp.Repost.PublicSignKey) {
+		return nil, nil, errors.New("repost author key mismatch")
+	}
+	err = s.model.verifyReposts(author.Onion, author.PublicSignKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp.Repost.Verified = true
+	return tp, author, nil
+}
+
+// Verify repost id by onion (own or cached) against the sign key served by
+// the original author at /info, marking their reposts as verified.
+func (s *Self) VerifyRepost(c *tor.PeerClient, onion string, id int64) (*TimelinePost, error) {
+	tp, _, err := s.repostAuthor(c, onion, id)
+	if err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// Publish repost of own or cached post by author onion.
+func (s *Self) Repost(onion string, id int64) (*Post, error) {
+	tp, err := s.model.getAnyPost(onion, id)
+	if err != nil {
+		return nil, err
+	}
+	if tp.Deleted || tp.Type == PostTypeDelete || tp.Type == PostTypeRepost {
+		return nil, errors.New("post can't be reposted")
+	}
+	if tp.Visibility != VisibilityPublic {
+		return nil, errors.New("only public posts can be reposted")
+	}
+	author := &s.Peer
+	if onion != s.Onion {
+		author, err = s.model.GetPeer(onion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	repost := &Repost{
+		Onion:         onion,
+		PublicSignKey: author.PublicSignKey,
+		Data:          tp.SignedData(onion),
+		Sig:           tp.Signature,
+	}
+	err = s.model.checkRepost(repost)
+	if err != nil {
+		return nil, err
+	}
+	// Keys of ourselves and known peers are trusted
+	repost.Verified = true
+	p := &Post{
+		Type:        PostTypeRepost,
+		Visibility:  VisibilityPublic,
+		Attachments: make([]string, 0),
+		Repost:      repost,
+		Sealed:      []byte{},
+		postKey:     []byte{},
+	}
+	err = s.appendEntry(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Subscribe to the original author of repost id by onion (own or cached)
+// after checking that their sign key matches the reposted entry.
+func (s *Self) SubscribeReposted(c *tor.PeerClient, onion string, id int64) (*Peer, error) {
+	_, author, err := s.repostAuthor(c, onion, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.SubscribeRequest(c, author.Onion)
+}
@@ -0,0 +1,218 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rule kinds.
+const (
+	// Reject subscribe requests, comments, reactions and messages from onion
+	RuleBlock = "block"
+	// Hide posts of onion from the timeline
+	RuleMute = "mute"
+	// Hide timeline posts containing keyword (case-insensitive)
+	RuleKeyword = "keyword"
+	// Hide timeline posts matching regular expression
+	RuleRegex = "regex"
+)
+
+// Onion ids of v2 and v3 hidden services (without the .onion suffix).
+var onionPattern = regexp.MustCompile(`^(?:[a-z2-7]{16}|[a-z2-7]{56})$`)
+
+const ruleSchema = `
+create table if not exists Rule (
+	id integer primary key autoincrement,
+	kind string not null,
+	value string not null,
+	created integer not null,
+	unique (kind, value)
+);
+`
+
+// Rule blocks or mutes a peer or filters timeline posts by content.
+type Rule struct {
+	ID      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	Value   string `json:"value"`
+	Created int64  `json:"created"`
+}
+
+// Insert model into DB. Blocking a peer also drops them as a follower.
+func (rl *Rule) Insert(m *Model) error {
+	switch rl.Kind {
+	case RuleBlock, RuleMute:
+		rl.Value = strings.ToLower(strings.TrimSpace(rl.Value))
+		rl.Value = strings.TrimSuffix(rl.Value, ".onion")
+		if !onionPattern.MatchString(rl.Value) {
+			return errors.New("bad onion")
+		}
+	case RuleKeyword:
+		rl.Value = strings.ToLower(strings.TrimSpace(rl.Value))
+	case RuleRegex:
+		_, err := regexp.Compile(rl.Value)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("bad rule kind")
+	}
+	if len(rl.Value) == 0 {
+		return errors.New("bad rule value")
+	}
+	rl.Created = time.Now().Unix()
+	result, err := m.db.Exec(
+		`insert into Rule (
+			kind,
+			value,
+			created
+		) values (
+			?,
+			?,
+			?
+		)`,
+		rl.Kind,
+		rl.Value,
+		rl.Created,
+	)
+	if err != nil {
+		return err
+	}
+	rl.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if rl.Kind == RuleBlock {
+		_, err = m.db.Exec(`update Peer set follower = 0 where onion = ?`, rl.Value)
+	}
+	return err
+}
+
+// Return rules of kind (empty for all rules).
+func (m *Model) GetRules(kind string) ([]*Rule, error) {
+	rows, err := m.db.Query(`
+		select
+			id,
+			kind,
+			value,
+			created
+		from Rule
+		where ? = '' or kind = ?
+		order by id
+	`, kind, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make([]*Rule, 0)
+	for rows.Next() {
+		rl := &Rule{}
+		err = rows.Scan(
+			&rl.ID,
+			&rl.Kind,
+			&rl.Value,
+			&rl.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rl)
+	}
+	return rules, nil
+}
+
+// Delete rule by id (sql.ErrNoRows if there is no such rule).
+func (m *Model) DeleteRule(id int64) error {
+	result, err := m.db.Exec(`delete from Rule where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Return true if onion is blocked.
+func (m *Model) IsBlocked(onion string) bool {
+	var count int
+	row := m.db.QueryRow(
+		`select count(*) from Rule where kind = ? and value = ?`,
+		RuleBlock,
+		onion,
+	)
+	err := row.Scan(&count)
+	return err == nil && count > 0
+}
+
+// Return true if post of peer at onion is hidden from the timeline by a
+// mute, block, keyword or regex rule.
+func (m *Model) isHidden(onion string, p *Post) bool {
+	var count int
+	row := m.db.QueryRow(
+		`select count(*) from Rule where kind in (?, ?) and value = ?`,
+		RuleMute,
+		RuleBlock,
+		onion,
+	)
+	err := row.Scan(&count)
+	if err != nil || count > 0 {
+		return true
+	}
+	f, err := m.getContentFilter()
+	return err != nil || f.match(p)
+}
+
+// Content filter built from keyword and regex rules.
+type contentFilter struct {
+	keywords []string
+	patterns []*regexp.Regexp
+}
+
+// Return content filter from current rules.
+func (m *Model) getContentFilter() (*contentFilter, error) {
+	rules, err := m.GetRules("")
+	if err != nil {
+		return nil, err
+	}
+	f := &contentFilter{}
+	for _, rl := range rules {
+		switch rl.Kind {
+		case RuleKeyword:
+			f.keywords = append(f.keywords, rl.Value)
+		case RuleRegex:
+			re, err := regexp.Compile(rl.Value)
+			if err == nil {
+				f.patterns = append(f.patterns, re)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Return true if post body (or body of reposted post) matches the filter.
+func (f *contentFilter) match(p *Post) bool {
+	body := p.Body
+	if p.Repost != nil && p.Repost.Post != nil {
+		body = p.Repost.Post.Body
+	}
+	lower := strings.ToLower(body)
+	for _, keyword := range f.keywords {
+		if strings.Contains(lower, keyword) {
+			return true
+		}
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(body) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"strings"
+)
+
+// Kinds of indexed items.
+const (
+	SearchPost    = "post"
+	SearchRepost  = "repost"
+	SearchComment = "comment"
+	SearchMessage = "message"
+)
+
+// Full-text index (requires building with the sqlite_fts5 tag). Posts are
+// indexed by original id so edits replace the indexed body.
+const searchSchema = `
+create virtual table if not exists Search using fts5 (
+	kind unindexed,
+	onion unindexed,
+	ref unindexed,
+	created unindexed,
+	body
+);
+`
+
+// SearchQuery holds search terms and optional filters.
+type SearchQuery struct {
+	Query string
+	// Onion of author (or sender of messages)
+	Onion string
+	Kind  string
+	// Unix time range (zero for unbounded)
+	Since int64
+	Until int64
+	Limit int
+}
+
+// SearchResult is a matched item with a highlighted snippet of its body.
+type SearchResult struct {
+	Kind    string `json:"kind"`
+	Onion   string `json:"onion"`
+	ID      int64  `json:"id"`
+	Created int64  `json:"created"`
+	Snippet string `json:"snippet"`
+}
+
+// Return onion of own node.
+func (m *Model) selfOnion() string {
+	var onion string
+	m.db.QueryRow(`select onion from Self`).Scan(&onion)
+	return onion
+}
+
+// Replace indexed body of item (removing it if body is empty).
+func (m *Model) index(kind, onion string, ref, created int64, body string) error {
+	err := m.unindex(kind, onion, ref)
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	_, err = m.db.Exec(
+		`insert into Search (kind, onion, ref, created, body) values (?, ?, ?, ?, ?)`,
+		kind,
+		onion,
+		ref,
+		created,
+		body,
+	)
+	return err
+}
+
+// Remove item from index.
+func (m *Model) unindex(kind, onion string, ref int64) error {
+	_, err := m.db.Exec(
+		`delete from Search where kind = ? and onion = ? and ref = ?`,
+		kind,
+		onion,
+		ref,
+	)
+	return err
+}
+
+// Index post entry of author onion under its original post id.
+func (m *Model) indexPost(onion string, p *Post) error {
+	if p.Deleted || p.Type == PostTypeDelete {
+		return nil
+	}
+	ref := p.ID
+	if p.Revises != 0 {
+		ref = p.Revises
+	}
+	if p.Repost != nil {
+		body := ""
+		if p.Repost.Post != nil {
+			body = p.Repost.Post.Body
+		}
+		return m.index(SearchRepost, onion, ref, p.Created, body)
+	}
+	return m.index(SearchPost, onion, ref, p.Created, p.Body)
+}
+
+// Return FTS5 query matching all terms of user query as literal strings.
+func matchQuery(q string) string {
+	terms := strings.Fields(q)
+	for i, t := range terms {
+		terms[i] = `"` + strings.Replace(t, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// Return items matching query (best matches first).
+func (m *Model) Search(sq *SearchQuery) ([]*SearchResult, error) {
+	match := matchQuery(sq.Query)
+	results := make([]*SearchResult, 0)
+	if len(match) == 0 {
+		return results, nil
+	}
+	limit := sq.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := m.db.Query(`
+		select
+			kind,
+			onion,
+			ref,
+			created,
+			snippet(Search, 4, '[', ']', '...', 16)
+		from Search
+		where Search match ?
+			and (? = '' or onion = ?)
+			and (? = '' or kind = ?)
+			and (? = 0 or created >= ?)
+			and (? = 0 or created <= ?)
+		order by rank
+		limit ?
+	`,
+		match,
+		sq.Onion, sq.Onion,
+		sq.Kind, sq.Kind,
+		sq.Since, sq.Since,
+		sq.Until, sq.Until,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &SearchResult{}
+		err = rows.Scan(
+			&r.Kind,
+			&r.Onion,
+			&r.ID,
+			&r.Created,
+			&r.Snippet,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
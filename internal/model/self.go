@@ -3,7 +3,9 @@ package model
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"github.com/wybiral/pub/pkg/tor"
 	"github.com/wybiral/pub/pkg/tor/onions"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/sign"
@@ -13,10 +15,11 @@ import (
 )
 
 const selfSchema = `
-create table Self (
+create table if not exists Self (
 	onion string not null,
 	name string not null,
 	about string not null,
+	avatar string not null,
 	onion_key_type string not null,
 	private_onion_key blob not null,
 	public_box_key blob not null,
@@ -43,6 +46,7 @@ func (m *Model) GetSelf() (*Self, error) {
 			onion,
 			name,
 			about,
+			avatar,
 			onion_key_type,
 			private_onion_key,
 			public_box_key,
@@ -55,6 +59,7 @@ func (m *Model) GetSelf() (*Self, error) {
 		&s.Onion,
 		&s.Name,
 		&s.About,
+		&s.Avatar,
 		&s.OnionKeyType,
 		&s.PrivateOnionKey,
 		&s.PublicBoxKey,
@@ -99,6 +104,7 @@ func (m *Model) CreateSelf(name, about string) (*Self, error) {
 			onion,
 			name,
 			about,
+			avatar,
 			onion_key_type,
 			private_onion_key,
 			public_box_key,
@@ -114,11 +120,13 @@ func (m *Model) CreateSelf(name, about string) (*Self, error) {
 			?,
 			?,
 			?,
+			?,
 			?
 		)`,
 		s.Onion,
 		s.Name,
 		s.About,
+		s.Avatar,
 		s.OnionKeyType,
 		s.PrivateOnionKey,
 		s.PublicBoxKey,
@@ -155,8 +163,35 @@ func (s *Self) Open(data []byte, peerPublicBoxKey []byte) ([]byte, bool) {
 	return box.Open(nil, data, &nonce, &publicKey, &privateKey)
 }
 
+// Return detached signature of data using private sign key.
+func (s *Self) Sign(data []byte) []byte {
+	var privateKey [64]byte
+	copy(privateKey[:], s.PrivateSignKey)
+	signed := sign.Sign(nil, data, &privateKey)
+	return signed[:sign.Overhead]
+}
+
+// Set profile avatar to a locally stored blob hash (empty string to clear).
+func (s *Self) SetAvatar(hash string) error {
+	if len(hash) > 0 {
+		ok, err := s.model.HasBlob(hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("blob not found")
+		}
+	}
+	_, err := s.model.db.Exec(`update Self set avatar = ?`, hash)
+	if err != nil {
+		return err
+	}
+	s.Avatar = hash
+	return nil
+}
+
 // Make subscribe request to peer at onion.
-func (s *Self) SubscribeRequest(c *http.Client, onion string) (*Peer, error) {
+func (s *Self) SubscribeRequest(c *tor.PeerClient, onion string) (*Peer, error) {
 	peer, err := s.model.GetPeerByOnion(c, onion)
 	if err != nil {
 		return nil, err
@@ -164,12 +199,18 @@ func (s *Self) SubscribeRequest(c *http.Client, onion string) (*Peer, error) {
 	// Create random secret
 	secret := make([]byte, 32)
 	rand.Read(secret)
+	// Create ephemeral key to bootstrap session
+	publicKey, privateKey, err := ephemeralKey()
+	if err != nil {
+		return nil, err
+	}
 	now := time.Now().Unix()
 	// Construct auth payload
 	auth := []byte("subscribe:")
 	auth = append(auth, []byte(strconv.FormatInt(now, 10))...)
 	auth = append(auth, []byte(":")...)
 	auth = append(auth, secret...)
+	auth = append(auth, publicKey[:]...)
 	auth = s.Seal(auth, peer.PublicBoxKey)
 	// Make request
 	addr := "http://" + onion + ".onion/subscribe"
@@ -178,61 +219,97 @@ func (s *Self) SubscribeRequest(c *http.Client, onion string) (*Peer, error) {
 	if err != nil {
 		return nil, err
 	}
-	res, err := c.Do(req)
+	res, err := c.Do(req, maxInfoSize)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
-		return nil, errors.New("unable to subscribe")
+	var reply *Rekey
+	err = json.Unmarshal(res.Body, &reply)
+	if err != nil {
+		return nil, tor.BadResponse(req, err)
 	}
 	peer.SecretAuthKey = secret
+	peer.Following = true
 	err = peer.Insert(s.model)
 	if err != nil {
 		return nil, err
 	}
+	// Peers without session support reply without a key
+	if reply != nil && len(reply.Key) > 0 {
+		err = s.finishRekey(peer, publicKey, privateKey, reply, false)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return peer, nil
 }
 
-// Accept a subscribe request by onion with auth payload.
-func (s *Self) SubscribeAccept(c *http.Client, onion string, auth []byte) (*Peer, error) {
+// Accept a subscribe request by onion with auth payload. Returns the rekey
+// reply to bootstrap a session if the payload carried an ephemeral key. New
+// followers are kept pending until approved if pending is set.
+func (s *Self) SubscribeAccept(c *tor.PeerClient, onion string, auth []byte, pending bool) (*Peer, *Rekey, error) {
 	// Get info for peer at onion
 	peer, err := s.model.GetPeerByOnion(c, onion)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// Open sealed auth payload
 	opened, ok := s.Open(auth, peer.PublicBoxKey)
 	if !ok {
-		return nil, errors.New("box not opened")
+		return nil, nil, errors.New("box not opened")
 	}
 	parts := bytes.SplitN(opened, []byte(":"), 3)
 	if len(parts) != 3 {
-		return nil, errors.New("bad auth")
+		return nil, nil, errors.New("bad auth")
 	}
 	// Verify payload prefix
 	if string(parts[0]) != "subscribe" {
-		return nil, errors.New("no subcribe tag")
+		return nil, nil, errors.New("no subcribe tag")
 	}
 	timestamp, err := strconv.ParseInt(string(parts[1]), 10, 64)
 	// Verify integer timestamp
 	if err != nil {
-		return nil, errors.New("bad timestamp")
+		return nil, nil, errors.New("bad timestamp")
 	}
 	// Verify timestamp TTL
 	now := time.Now().Unix()
 	difference := now - timestamp
 	ttl := int64(60 * 15)
 	if difference < -ttl || difference > ttl {
-		return nil, errors.New("timestamp out of range")
+		return nil, nil, errors.New("timestamp out of range")
 	}
-	// Verify length of session secret
-	if len(parts[2]) != 32 {
-		return nil, errors.New("invalid secret length")
+	// Verify length of session secret (optionally followed by ephemeral key)
+	if len(parts[2]) != 32 && len(parts[2]) != 64 {
+		return nil, nil, errors.New("invalid secret length")
 	}
-	peer.SecretAuthKey = parts[2]
+	// Renewed subscriptions of existing followers aren't notified
+	existing, err := s.model.GetPeer(peer.Onion)
+	isNew := err != nil || !existing.Follower
+	peer.SecretAuthKey = parts[2][:32]
+	peer.Follower = !isNew || !pending
+	peer.Pending = !peer.Follower
 	err = peer.Insert(s.model)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return peer, nil
+	s.model.Emit(EventSubscribe, peer)
+	if peer.Pending {
+		err = s.model.notify(NotifyPending, peer.Onion, 0, "")
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if isNew {
+		err = s.model.notify(NotifyFollower, peer.Onion, 0, "")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(parts[2]) == 32 {
+		return peer, nil, nil
+	}
+	rekey, err := s.acceptRekey(peer, parts[2][32:], false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return peer, rekey, nil
 }
@@ -0,0 +1,347 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/wybiral/pub/pkg/tor"
+	"golang.org/x/crypto/nacl/box"
+	"net/http"
+	"time"
+)
+
+const sessionSchema = `
+create table if not exists Session (
+	onion string primary key,
+	session_key blob not null,
+	prev_session_key blob not null,
+	prev_auth_key blob not null,
+	pending_session_key blob not null,
+	pending_auth_key blob not null,
+	created integer not null
+);
+`
+
+// Session holds keys derived from ephemeral key agreement with a peer.
+// Ephemeral private keys are never stored and previous keys are only kept
+// until the next rotation, so old traffic can't be opened with current keys.
+// Keys agreed as responder stay pending until the initiator uses them.
+type Session struct {
+	Onion             string
+	SessionKey        []byte
+	PrevSessionKey    []byte
+	PrevAuthKey       []byte
+	PendingSessionKey []byte
+	PendingAuthKey    []byte
+	Created           int64
+}
+
+// Rekey payload carrying an ephemeral public key (signed in replies).
+type Rekey struct {
+	Key []byte `json:"key"`
+	Sig []byte `json:"sig,omitempty"`
+}
+
+// Return session with peer by onion.
+func (m *Model) GetSession(onion string) (*Session, error) {
+	ss := &Session{}
+	row := m.db.QueryRow(`
+		select
+			onion,
+			session_key,
+			prev_session_key,
+			prev_auth_key,
+			pending_session_key,
+			pending_auth_key,
+			created
+		from Session
+		where onion = ?
+	`, onion)
+	err := row.Scan(
+		&ss.Onion,
+		&ss.SessionKey,
+		&ss.PrevSessionKey,
+		&ss.PrevAuthKey,
+		&ss.PendingSessionKey,
+		&ss.PendingAuthKey,
+		&ss.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Generate ephemeral X25519 key pair.
+func ephemeralKey() (*[32]byte, *[32]byte, error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+// Return data covered by the signature of a rekey reply.
+func rekeySignedData(initiatorKey, responderKey []byte) []byte {
+	data := []byte("rekey:")
+	data = append(data, initiatorKey...)
+	return append(data, responderKey...)
+}
+
+// Derive a purpose specific key from agreed root key.
+func deriveKey(root *[32]byte, purpose string) []byte {
+	sum := sha256.Sum256(append([]byte(purpose+":"), root[:]...))
+	return sum[:]
+}
+
+// Replace session keys for peer using agreed root key (optionally also
+// rotating SecretAuthKey). Current keys are kept as previous keys so
+// in-flight traffic can still be opened.
+func (m *Model) rotateSession(peer *Peer, root *[32]byte, rotateAuth bool) error {
+	prevSessionKey := []byte{}
+	ss, err := m.GetSession(peer.Onion)
+	if err == nil {
+		prevSessionKey = ss.SessionKey
+	}
+	prevAuthKey := []byte{}
+	authKey := peer.SecretAuthKey
+	if rotateAuth {
+		prevAuthKey = peer.SecretAuthKey
+		authKey = deriveKey(root, "auth")
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`insert or replace into Session (
+			onion,
+			session_key,
+			prev_session_key,
+			prev_auth_key,
+			pending_session_key,
+			pending_auth_key,
+			created
+		) values (
+			?,
+			?,
+			?,
+			?,
+			x'',
+			x'',
+			?
+		)`,
+		peer.Onion,
+		deriveKey(root, "session"),
+		prevSessionKey,
+		prevAuthKey,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`update Peer set secret_auth_key = ? where onion = ?`,
+		authKey,
+		peer.Onion,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	peer.SecretAuthKey = authKey
+	return nil
+}
+
+// Stage keys for peer from agreed root key as responder. Current keys stay in
+// use until the initiator confirms the new ones by authenticating with them
+// (see commitSession), so a lost rekey reply can't lock the initiator out.
+func (m *Model) stageSession(peer *Peer, root *[32]byte) error {
+	_, err := m.db.Exec(
+		`insert into Session (
+			onion,
+			session_key,
+			prev_session_key,
+			prev_auth_key,
+			pending_session_key,
+			pending_auth_key,
+			created
+		) values (
+			?,
+			x'',
+			x'',
+			x'',
+			?,
+			?,
+			?
+		) on conflict(onion) do update set
+			pending_session_key = excluded.pending_session_key,
+			pending_auth_key = excluded.pending_auth_key`,
+		peer.Onion,
+		deriveKey(root, "session"),
+		deriveKey(root, "auth"),
+		time.Now().Unix(),
+	)
+	return err
+}
+
+// Make staged keys of peer current once confirmed (current keys are kept as
+// previous keys).
+func (m *Model) commitSession(peer *Peer, ss *Session) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		update Session set
+			prev_session_key = session_key,
+			session_key = pending_session_key,
+			prev_auth_key = ?,
+			pending_session_key = x'',
+			pending_auth_key = x'',
+			created = ?
+		where onion = ?
+	`, peer.SecretAuthKey, time.Now().Unix(), peer.Onion)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`update Peer set secret_auth_key = ? where onion = ?`,
+		ss.PendingAuthKey,
+		peer.Onion,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	peer.SecretAuthKey = ss.PendingAuthKey
+	return nil
+}
+
+// Respond to ephemeral key from peer with our own signed ephemeral key.
+func (s *Self) acceptRekey(peer *Peer, key []byte, rotateAuth bool) (*Rekey, error) {
+	if len(key) != 32 {
+		return nil, errors.New("bad rekey")
+	}
+	publicKey, privateKey, err := ephemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	var peerKey [32]byte
+	var root [32]byte
+	copy(peerKey[:], key)
+	box.Precompute(&root, &peerKey, privateKey)
+	if rotateAuth {
+		err = s.model.stageSession(peer, &root)
+	} else {
+		err = s.model.rotateSession(peer, &root, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Rekey{
+		Key: publicKey[:],
+		Sig: s.Sign(rekeySignedData(key, publicKey[:])),
+	}, nil
+}
+
+// Complete key agreement with peer from their signed rekey reply.
+func (s *Self) finishRekey(peer *Peer, publicKey, privateKey *[32]byte, reply *Rekey, rotateAuth bool) error {
+	if reply == nil || len(reply.Key) != 32 {
+		return errors.New("bad rekey")
+	}
+	if !peer.Verify(rekeySignedData(publicKey[:], reply.Key), reply.Sig) {
+		return errors.New("bad rekey signature")
+	}
+	var peerKey [32]byte
+	var root [32]byte
+	copy(peerKey[:], reply.Key)
+	box.Precompute(&root, &peerKey, privateKey)
+	return s.model.rotateSession(peer, &root, rotateAuth)
+}
+
+// Accept rekey request from authenticated peer, staging new keys for all
+// shared secrets.
+func (s *Self) AcceptRekey(peer *Peer, req *Rekey) (*Rekey, error) {
+	return s.acceptRekey(peer, req.Key, true)
+}
+
+// Agree on new session keys with peer and rotate SecretAuthKey.
+func (s *Self) Rekey(c *tor.PeerClient, peer *Peer) error {
+	publicKey, privateKey, err := ephemeralKey()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(Rekey{Key: publicKey[:]})
+	if err != nil {
+		return err
+	}
+	addr := "http://" + peer.Onion + ".onion/rekey"
+	req, err := http.NewRequest("POST", addr, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	s.AuthRequest(req, peer, body)
+	res, err := c.Do(req, maxInfoSize)
+	if err != nil {
+		return err
+	}
+	reply := &Rekey{}
+	err = json.Unmarshal(res.Body, reply)
+	if err != nil {
+		return tor.BadResponse(req, err)
+	}
+	return s.finishRekey(peer, publicKey, privateKey, reply, true)
+}
+
+// Return true if we should initiate rekeying with peer (only one side does).
+func (s *Self) IsRekeyInitiator(peer *Peer) bool {
+	if !peer.Following {
+		return false
+	}
+	return !peer.Follower || s.Onion < peer.Onion
+}
+
+// Seal data for peer using current session key (or long-term box keys if no
+// session has been agreed yet).
+func (s *Self) SealFor(peer *Peer, data []byte) []byte {
+	ss, err := s.model.GetSession(peer.Onion)
+	if err != nil || len(ss.SessionKey) != 32 {
+		return s.Seal(data, peer.PublicBoxKey)
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], ss.SessionKey)
+	rand.Read(nonce[:])
+	return box.SealAfterPrecomputation(nonce[:], data, &nonce, &key)
+}
+
+// Open data sealed by peer with current, pending, previous or long-term keys.
+func (s *Self) OpenFrom(peer *Peer, data []byte) ([]byte, bool) {
+	if len(data) < 24 {
+		return nil, false
+	}
+	ss, err := s.model.GetSession(peer.Onion)
+	if err == nil {
+		var nonce [24]byte
+		copy(nonce[:], data[:24])
+		for _, k := range [][]byte{ss.SessionKey, ss.PendingSessionKey, ss.PrevSessionKey} {
+			if len(k) != 32 {
+				continue
+			}
+			var key [32]byte
+			copy(key[:], k)
+			opened, ok := box.OpenAfterPrecomputation(nil, data[24:], &nonce, &key)
+			if ok {
+				return opened, true
+			}
+		}
+	}
+	return s.Open(data, peer.PublicBoxKey)
+}
@@ -0,0 +1,177 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Return inbox request with body from s authenticated with key.
+func testAuthRequest(s *Self, peer *Peer, key []byte, body []byte) *http.Request {
+	req := httptest.NewRequest("POST", "/inbox", bytes.NewReader(body))
+	p := *peer
+	p.SecretAuthKey = key
+	s.AuthRequest(req, &p, body)
+	return req
+}
+
+func TestAuthPeerRekey(t *testing.T) {
+	tests := []struct {
+		name string
+		// Initiator received the rekey reply
+		finished bool
+		// Auth keys used by the initiator in order ("old", "new" or "other")
+		auth []string
+		want []string
+		// Responder made the new keys current
+		committed bool
+	}{
+		{
+			name:      "reply lost",
+			finished:  false,
+			auth:      []string{"old", "old"},
+			want:      []string{"", ""},
+			committed: false,
+		},
+		{
+			name:      "not used yet",
+			finished:  true,
+			auth:      []string{},
+			want:      []string{},
+			committed: false,
+		},
+		{
+			name:      "confirmed by new key",
+			finished:  true,
+			auth:      []string{"new"},
+			want:      []string{""},
+			committed: true,
+		},
+		{
+			name:      "old key before confirming",
+			finished:  true,
+			auth:      []string{"old", "new"},
+			want:      []string{"", ""},
+			committed: true,
+		},
+		{
+			name:      "old key after confirming",
+			finished:  true,
+			auth:      []string{"new", "old", "new"},
+			want:      []string{"", "", ""},
+			committed: true,
+		},
+		{
+			name:      "other key",
+			finished:  true,
+			auth:      []string{"other"},
+			want:      []string{"bad auth"},
+			committed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am, a := newTestSelf(t)
+			bm, b := newTestSelf(t)
+			peerB, peerA := testFollow(t, am, a, bm, b)
+			keys := map[string][]byte{
+				"old":   append([]byte{}, peerB.SecretAuthKey...),
+				"other": make([]byte, 32),
+			}
+			rand.Read(keys["other"])
+			// a initiates, b responds
+			publicKey, privateKey, err := ephemeralKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := b.AcceptRekey(peerA, &Rekey{Key: publicKey[:]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.finished {
+				err = a.finishRekey(peerB, publicKey, privateKey, reply, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys["new"] = peerB.SecretAuthKey
+			}
+			for i, name := range tt.auth {
+				body := []byte("body")
+				_, err := bm.AuthPeer(testAuthRequest(a, peerB, keys[name], body), body)
+				got := ""
+				if err != nil {
+					got = err.Error()
+				}
+				if got != tt.want[i] {
+					t.Errorf("auth %d with %s key: got %q, want %q", i, name, got, tt.want[i])
+				}
+			}
+			known, err := bm.GetPeer(a.Onion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "old"
+			if tt.committed {
+				want = "new"
+			}
+			if !bytes.Equal(known.SecretAuthKey, keys[want]) {
+				t.Errorf("responder doesn't use the %s auth key", want)
+			}
+			// Either side can open what the other sealed
+			sealed := a.SealFor(peerB, []byte("to b"))
+			opened, ok := b.OpenFrom(known, sealed)
+			if !ok || string(opened) != "to b" {
+				t.Error("responder can't open sealed data")
+			}
+			sealed = b.SealFor(known, []byte("to a"))
+			opened, ok = a.OpenFrom(peerB, sealed)
+			if !ok || string(opened) != "to a" {
+				t.Error("initiator can't open sealed data")
+			}
+		})
+	}
+}
+
+func TestAuthPeerHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   string
+	}{
+		{"valid", "", "", ""},
+		{"unknown peer", "Peer", "nobody", "unknown peer"},
+		{"bad timestamp", "Timestamp", "x", "bad timestamp"},
+		{"old timestamp", "Timestamp", strconv.FormatInt(time.Now().Unix()-2*authTTL, 10), "timestamp out of range"},
+		{"future timestamp", "Timestamp", strconv.FormatInt(time.Now().Unix()+2*authTTL, 10), "timestamp out of range"},
+		{"bad encoding", "Auth", "!", "bad auth"},
+		{"bad mac", "Auth", "AAAA", "bad auth"},
+	}
+	am, a := newTestSelf(t)
+	bm, b := newTestSelf(t)
+	peerB, _ := testFollow(t, am, a, bm, b)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte("body")
+			req := testAuthRequest(a, peerB, peerB.SecretAuthKey, body)
+			if len(tt.header) > 0 {
+				req.Header.Set(tt.header, tt.value)
+			}
+			peer, err := bm.AuthPeer(req, body)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if err == nil && peer.Onion != a.Onion {
+				t.Errorf("got peer %s, want %s", peer.Onion, a.Onion)
+			}
+		})
+	}
+}
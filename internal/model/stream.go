@@ -0,0 +1,53 @@
+package model
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/wybiral/pub/pkg/tor"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum size of a single streamed feed entry in bytes.
+const maxStreamEntry = 1 << 20
+
+// Streams are dropped if nothing (not even a keep-alive) is read for this long.
+const streamIdleTimeout = 2 * time.Minute
+
+// Receive new entries of followed peer's feed log over a streaming
+// connection (authenticated) until it's closed by either side. Returns the
+// number of entries stored.
+func (s *Self) StreamPeer(c *tor.PeerClient, peer *Peer) (int, error) {
+	req, err := http.NewRequest("GET", "http://"+peer.Onion+".onion/stream", nil)
+	if err != nil {
+		return 0, err
+	}
+	s.AuthRequest(req, peer, nil)
+	res, err := c.Stream(req, streamIdleTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	count := 0
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64<<10), maxStreamEntry)
+	for scanner.Scan() {
+		// Only data lines carry entries (event names and comments are skipped)
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		p := &Post{}
+		err = json.Unmarshal([]byte(line[len("data: "):]), p)
+		if err != nil {
+			return count, err
+		}
+		err = s.ReceivePost(peer, p)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
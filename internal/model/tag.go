@@ -0,0 +1,154 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Limits for tags of a single post.
+const (
+	maxTags      = 16
+	maxTagLength = 32
+)
+
+const tagSchema = `
+create table if not exists Tag (
+	onion string not null,
+	post integer not null,
+	tag string not null,
+	public integer not null,
+	primary key (onion, post, tag)
+);
+create index if not exists tag_tag on Tag (tag);
+`
+
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+
+// Hashtags start at the beginning of the body or after a character that
+// can't be part of a word, URL or entity (so "page#anchor" isn't a tag).
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/#])#([\p{L}\p{N}_]+)`)
+
+// Return tag in canonical form (false if it isn't a valid tag).
+func NormalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	if len(tag) == 0 || len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+		return "", false
+	}
+	return tag, true
+}
+
+// Return explicit tags of own post in canonical form without duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTags {
+		return nil, errors.New("too many tags")
+	}
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag, ok := NormalizeTag(tag)
+		if !ok {
+			return nil, errors.New("bad tag")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// Return valid explicit tags and hashtags of post without duplicates.
+func postTags(p *Post) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		tag, ok := NormalizeTag(tag)
+		if ok && !seen[tag] && len(tags) < 2*maxTags {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range p.Tags {
+		add(tag)
+	}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(p.Body, -1) {
+		add(match[1])
+	}
+	return tags
+}
+
+// Replace tags of post entry of author onion (stored under the original id
+// so edits retag the post).
+func (m *Model) tagPost(onion string, p *Post) error {
+	if p.Deleted || p.Type == PostTypeDelete {
+		return nil
+	}
+	id := p.ID
+	if p.Revises != 0 {
+		id = p.Revises
+	}
+	err := m.untagPost(onion, id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range postTags(p) {
+		_, err = m.db.Exec(
+			`insert or ignore into Tag (
+				onion,
+				post,
+				tag,
+				public
+			) values (
+				?,
+				?,
+				?,
+				?
+			)`,
+			onion,
+			id,
+			tag,
+			p.Visibility == VisibilityPublic,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove tags of post of author onion.
+func (m *Model) untagPost(onion string, id int64) error {
+	_, err := m.db.Exec(
+		`delete from Tag where onion = ? and post = ?`,
+		onion,
+		id,
+	)
+	return err
+}
+
+// Return most used tags of own public posts.
+func (m *Model) GetTopTags(limit int) ([]string, error) {
+	rows, err := m.db.Query(`
+		select tag
+		from Tag
+		where onion = (select onion from Self) and public = 1
+		group by tag
+		order by count(*) desc, tag
+		limit ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
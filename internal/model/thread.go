@@ -0,0 +1,191 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Maximum number of ancestors followed when looking for the thread root.
+const maxThreadDepth = 64
+
+// Union of own and cached peer posts with the onion of their author.
+const allPostsQuery = `
+	select (select onion from Self) as author, ` + postColumns + `
+	from Post
+	union all
+	select onion as author, ` + postColumns + `
+	from PeerPost
+`
+
+// Condition that the reference of reply r matches the hash of a cached entry
+// of the referenced post (the original or one of its revisions). Each table
+// is looked up by its hash index.
+const verifiedReply = `(exists (
+	select 1 from Post
+	where hash = r.reply_hash and r.reply_onion = (select onion from Self)
+	and (id = r.reply_id or revises = r.reply_id)
+) or exists (
+	select 1 from PeerPost
+	where onion = r.reply_onion and hash = r.reply_hash
+	and (id = r.reply_id or revises = r.reply_id)
+))`
+
+// Return own or cached peer post by author onion and id.
+func (m *Model) getAnyPost(onion string, id int64) (*TimelinePost, error) {
+	tp := &TimelinePost{}
+	row := m.db.QueryRow(`
+		select * from (`+allPostsQuery+`)
+		where author = ? and id = ?
+	`, onion, id)
+	p, err := scanPost(row, &tp.Onion)
+	if err != nil {
+		return nil, err
+	}
+	tp.Post = p
+	return tp, nil
+}
+
+// Return reference to own or cached peer post for replying to it. Revisions
+// are referenced by the original post id and the hash of the revision.
+func (m *Model) resolveRef(onion string, id int64) (*PostRef, error) {
+	tp, err := m.getAnyPost(onion, id)
+	if err != nil {
+		return nil, errors.New("reply target not found")
+	}
+	if tp.Deleted || tp.Type == PostTypeDelete {
+		return nil, errors.New("can't reply to deleted post")
+	}
+	ref := &PostRef{Onion: onion, ID: tp.ID, Hash: tp.hash}
+	if tp.Revises != 0 {
+		ref.ID = tp.Revises
+	}
+	return ref, nil
+}
+
+// Return true if ref matches the hash of a cached entry of the referenced
+// post (the original or one of its revisions).
+func (m *Model) verifyRef(ref *PostRef) bool {
+	var count int
+	row := m.db.QueryRow(`
+		select count(*)
+		from (select ? as reply_onion, ? as reply_id, ? as reply_hash) as r
+		where `+verifiedReply,
+		ref.Onion,
+		ref.ID,
+		ref.Hash,
+	)
+	err := row.Scan(&count)
+	return err == nil && count > 0
+}
+
+// Return key identifying original post in reply references.
+func threadKey(onion string, p *Post) string {
+	id := p.ID
+	if p.Revises != 0 {
+		id = p.Revises
+	}
+	return onion + ":" + strconv.FormatInt(id, 10)
+}
+
+// Set number of known replies for each post (ignoring replies whose
+// reference doesn't match the post).
+func (m *Model) countReplies(posts []*TimelinePost) error {
+	rows, err := m.db.Query(`
+		select reply_onion, reply_id, count(*)
+		from (` + allPostsQuery + `) as r
+		where reply_onion != '' and deleted = 0 and revises = 0
+		and ` + verifiedReply + `
+		group by reply_onion, reply_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var onion string
+		var id int64
+		var count int
+		err = rows.Scan(&onion, &id, &count)
+		if err != nil {
+			return err
+		}
+		counts[onion+":"+strconv.FormatInt(id, 10)] = count
+	}
+	for _, tp := range posts {
+		tp.Replies = counts[threadKey(tp.Onion, tp.Post)]
+	}
+	return nil
+}
+
+// Return whole conversation thread containing post of author onion across
+// all cached feeds, starting at the earliest known ancestor and ordered
+// depth-first with replies oldest first. Replies are only attached to the
+// post matching the hash they reference.
+func (m *Model) GetThread(onion string, id int64) ([]*TimelinePost, error) {
+	tp, err := m.getAnyPost(onion, id)
+	if err != nil {
+		return nil, err
+	}
+	if tp.Revises != 0 {
+		tp, err = m.getAnyPost(onion, tp.Revises)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Walk up to the earliest ancestor we know about
+	for i := 0; i < maxThreadDepth && tp.ReplyTo != nil; i++ {
+		if !m.verifyRef(tp.ReplyTo) {
+			break
+		}
+		parent, err := m.getAnyPost(tp.ReplyTo.Onion, tp.ReplyTo.ID)
+		if err != nil {
+			break
+		}
+		tp = parent
+	}
+	// Index every reply by the post it references
+	rows, err := m.db.Query(`
+		select * from (` + allPostsQuery + `) as r
+		where reply_onion != '' and deleted = 0 and revises = 0
+		and ` + verifiedReply + `
+		order by created, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := scanTimelinePosts(rows)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string][]*TimelinePost)
+	for _, r := range replies {
+		key := r.ReplyTo.Onion + ":" + strconv.FormatInt(r.ReplyTo.ID, 10)
+		children[key] = append(children[key], r)
+	}
+	thread := make([]*TimelinePost, 0)
+	seen := make(map[string]bool)
+	var walk func(tp *TimelinePost, depth int)
+	walk = func(tp *TimelinePost, depth int) {
+		key := threadKey(tp.Onion, tp.Post)
+		if seen[key] || depth > maxThreadDepth {
+			return
+		}
+		seen[key] = true
+		tp.Depth = depth
+		tp.Replies = len(children[key])
+		thread = append(thread, tp)
+		for _, child := range children[key] {
+			walk(child, depth+1)
+		}
+	}
+	walk(tp, 0)
+	// Hide deleted posts but keep their replies
+	visible := make([]*TimelinePost, 0, len(thread))
+	for _, tp := range thread {
+		if !tp.Deleted {
+			visible = append(visible, tp)
+		}
+	}
+	return visible, m.applyRevisions(visible)
+}
@@ -0,0 +1,40 @@
+// Package markdown renders Markdown source into sanitized HTML that is safe to
+// serve over Tor (no scripts and no remote resources).
+package markdown
+
+import (
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+	"regexp"
+)
+
+// Images may only reference local content-addressed blobs.
+var blobSrc = regexp.MustCompile(`^/blobs/[0-9a-f]{64}$`)
+
+var policy = newPolicy()
+
+// Return sanitizing policy for rendered Markdown.
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements(
+		"p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"blockquote", "pre", "code", "em", "strong", "del",
+		"ul", "ol", "li", "table", "thead", "tbody", "tr", "th", "td",
+	)
+	// Links are allowed but never leak referrers
+	p.AllowStandardURLs()
+	p.AllowAttrs("href").OnElements("a")
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	// Images are only allowed from local blobs
+	p.AllowAttrs("src").Matching(blobSrc).OnElements("img")
+	p.AllowAttrs("alt", "title").OnElements("img")
+	return p
+}
+
+// Render Markdown source to sanitized HTML.
+func Render(src string) string {
+	unsafe := blackfriday.Run([]byte(src))
+	return string(policy.SanitizeBytes(unsafe))
+}
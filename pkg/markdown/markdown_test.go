@@ -0,0 +1,102 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	blob := "/blobs/" + strings.Repeat("ab", 32)
+	tests := []struct {
+		name string
+		src  string
+		// Substrings the output must and must not contain
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "formatting",
+			src:  "# Title\n\n**bold** and `code`",
+			want: []string{"<h1>Title</h1>", "<strong>bold</strong>", "<code>code</code>"},
+		},
+		{
+			name:    "script tag",
+			src:     "hi <script>alert(1)</script>",
+			want:    []string{"hi"},
+			notWant: []string{"<script", "alert(1)"},
+		},
+		{
+			name:    "event handler attribute",
+			src:     `<p onclick="alert(1)">hi</p>`,
+			want:    []string{"hi"},
+			notWant: []string{"onclick", "alert"},
+		},
+		{
+			name:    "event handler on image",
+			src:     `<img src="` + blob + `" onerror="alert(1)">`,
+			notWant: []string{"onerror", "alert"},
+		},
+		{
+			name:    "javascript link",
+			src:     "[click](javascript:alert(1))",
+			want:    []string{"click"},
+			notWant: []string{"javascript:", "href"},
+		},
+		{
+			name:    "javascript link in html",
+			src:     `<a href="javascript:alert(1)">click</a>`,
+			notWant: []string{"javascript:", "href"},
+		},
+		{
+			name: "http link",
+			src:  "[site](http://example.onion/)",
+			want: []string{`href="http://example.onion/"`, "nofollow", "noreferrer", `target="_blank"`},
+		},
+		{
+			name: "blob image",
+			src:  "![cat](" + blob + ")",
+			want: []string{`src="` + blob + `"`, `alt="cat"`},
+		},
+		{
+			name:    "remote image",
+			src:     "![cat](http://example.com/cat.png)",
+			notWant: []string{"src=", "example.com"},
+		},
+		{
+			name:    "relative image outside blobs",
+			src:     "![cat](/blobs/../avatar)",
+			notWant: []string{"src="},
+		},
+		{
+			name:    "data image",
+			src:     "![cat](data:image/png;base64,AAAA)",
+			notWant: []string{"src=", "data:"},
+		},
+		{
+			name:    "iframe",
+			src:     `<iframe src="http://example.com"></iframe>`,
+			notWant: []string{"<iframe", "example.com"},
+		},
+		{
+			name:    "style",
+			src:     `<p style="background:url(http://example.com)">hi</p>`,
+			want:    []string{"hi"},
+			notWant: []string{"style", "example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			html := Render(tt.src)
+			for _, s := range tt.want {
+				if !strings.Contains(html, s) {
+					t.Errorf("%q doesn't contain %q", html, s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(html, s) {
+					t.Errorf("%q contains %q", html, s)
+				}
+			}
+		})
+	}
+}
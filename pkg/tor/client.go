@@ -1,24 +1,64 @@
 package tor
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"golang.org/x/net/proxy"
+	"net"
 	"net/http"
-	"net/url"
+	"strconv"
+	"time"
 )
 
-// Return new Tor proxy client.
-func NewClient(host string, port int) (*http.Client, error) {
-	addr := fmt.Sprintf("socks5://%s:%d", host, port)
-	proxyAddr, err := url.Parse(addr)
+// Transport timeouts of Tor proxy clients.
+const (
+	dialTimeout           = time.Minute
+	responseHeaderTimeout = time.Minute
+	idleConnTimeout       = 90 * time.Second
+)
+
+// Return new Tor proxy client. With isolate set, connections to each
+// destination host use their own SOCKS credentials so that Tor builds
+// separate circuits per peer (IsolateSOCKSAuth, enabled by default in Tor).
+func NewClient(host string, port int, isolate bool) (*http.Client, error) {
+	proxyAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
 	if err != nil {
 		return nil, err
 	}
-	dialer, err := proxy.FromURL(proxyAddr, proxy.Direct)
+	// Random password keeps isolation groups distinct across restarts
+	secret := make([]byte, 16)
+	_, err = rand.Read(secret)
 	if err != nil {
 		return nil, err
 	}
-	transport := &http.Transport{Dial: dialer.Dial}
+	password := hex.EncodeToString(secret)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := dialer
+			if isolate {
+				dest, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				auth := &proxy.Auth{User: dest, Password: password}
+				d, err = proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+				if err != nil {
+					return nil, err
+				}
+			}
+			// Onion circuits are built while connecting through the proxy
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			if cd, ok := d.(proxy.ContextDialer); ok {
+				return cd.DialContext(ctx, network, addr)
+			}
+			return d.Dial(network, addr)
+		},
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+	}
 	client := &http.Client{Transport: transport}
 	return client, nil
 }
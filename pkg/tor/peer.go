@@ -0,0 +1,250 @@
+package tor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Kinds of peer request errors (matched with errors.Is).
+var (
+	ErrUnreachable = errors.New("peer unreachable")
+	ErrTimeout     = errors.New("peer timed out")
+	ErrBadResponse = errors.New("bad response from peer")
+)
+
+// PeerError is returned by PeerClient requests. Its Kind is one of
+// ErrUnreachable, ErrTimeout or ErrBadResponse.
+type PeerError struct {
+	Kind error
+	// Host of the request
+	Host string
+	// Status code of bad responses (zero if the response was unreadable)
+	Status int
+	Err    error
+}
+
+func (e *PeerError) Error() string {
+	msg := e.Kind.Error() + " " + e.Host
+	if e.Status != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.Status)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Kind
+}
+
+// Response of a peer request with its body read into memory.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// PeerClient makes bounded requests to peers over Tor.
+type PeerClient struct {
+	Client *http.Client
+	// Timeout of each attempt (including reading the body)
+	Timeout time.Duration
+	// Default maximum size of response bodies in bytes
+	MaxSize int64
+	// Number of retries of unreachable peers, timeouts and unavailable
+	// responses (only for GET and HEAD requests, others are never retried
+	// since they may have been applied)
+	Retries int
+	// Base delay between retries (doubled each retry, with random jitter)
+	RetryDelay time.Duration
+}
+
+// Return new PeerClient using client with default limits.
+func NewPeerClient(client *http.Client) *PeerClient {
+	return &PeerClient{
+		Client:     client,
+		Timeout:    2 * time.Minute,
+		MaxSize:    8 << 20,
+		Retries:    2,
+		RetryDelay: 5 * time.Second,
+	}
+}
+
+// Perform request and read a response body of up to limit bytes (MaxSize
+// if zero). Requests are bound to the request context and the per attempt
+// timeout. Responses other than 2xx or 304 Not Modified are bad responses.
+func (pc *PeerClient) Do(req *http.Request, limit int64) (*Response, error) {
+	if limit <= 0 {
+		limit = pc.MaxSize
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		var res *Response
+		res, err = pc.do(req, limit)
+		if err == nil {
+			return res, nil
+		}
+		if attempt >= pc.Retries || !idempotent(req) || !retryable(err) {
+			return nil, err
+		}
+		// Exponential backoff with jitter in [delay/2, delay)
+		delay := pc.RetryDelay << uint(attempt)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, peerError(req, req.Context().Err())
+		}
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		} else if req.Body != nil {
+			// Bodies that can't be replayed can't be retried
+			return nil, errors.New("request body not replayable")
+		}
+	}
+}
+
+// Perform a single attempt of request.
+func (pc *PeerClient) do(req *http.Request, limit int64) (*Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), pc.Timeout)
+	defer cancel()
+	res, err := pc.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, peerError(req, err)
+	}
+	defer res.Body.Close()
+	if !statusOK(res.StatusCode) {
+		// Drain a little of the body so the connection can be reused
+		io.CopyN(ioutil.Discard, res.Body, 4<<10)
+		return nil, &PeerError{
+			Kind:   ErrBadResponse,
+			Host:   req.URL.Host,
+			Status: res.StatusCode,
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, peerError(req, err)
+	}
+	if int64(len(body)) > limit {
+		return nil, BadResponse(req, errors.New("response too large"))
+	}
+	return &Response{
+		Status: res.StatusCode,
+		Header: res.Header,
+		Body:   body,
+	}, nil
+}
+
+// Open request with a streamed response body that the caller must close.
+// Connecting is bound by the per attempt timeout and the stream is closed
+// if no data is read for idle.
+func (pc *PeerClient) Stream(req *http.Request, idle time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(pc.Timeout, cancel)
+	res, err := pc.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if !timer.Stop() {
+			err = context.DeadlineExceeded
+		}
+		return nil, peerError(req, err)
+	}
+	if !statusOK(res.StatusCode) {
+		cancel()
+		res.Body.Close()
+		return nil, &PeerError{
+			Kind:   ErrBadResponse,
+			Host:   req.URL.Host,
+			Status: res.StatusCode,
+		}
+	}
+	timer.Reset(idle)
+	res.Body = &idleBody{ReadCloser: res.Body, timer: timer, idle: idle, cancel: cancel}
+	return res, nil
+}
+
+// Response body that cancels its request when reads stall.
+type idleBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	idle   time.Duration
+	cancel context.CancelFunc
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Return bad response error for request whose response failed to decode.
+func BadResponse(req *http.Request, err error) error {
+	return &PeerError{
+		Kind: ErrBadResponse,
+		Host: req.URL.Host,
+		Err:  err,
+	}
+}
+
+// Return true if status is a successful or not modified response.
+func statusOK(status int) bool {
+	return (status >= 200 && status < 300) || status == http.StatusNotModified
+}
+
+// Return true if request can be repeated without side effects.
+func idempotent(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+// Return true if request failing with err is worth retrying.
+func retryable(err error) bool {
+	pe, ok := err.(*PeerError)
+	if !ok {
+		return false
+	}
+	switch pe.Kind {
+	case ErrUnreachable, ErrTimeout:
+		return true
+	}
+	switch pe.Status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Return typed error for request failing with transport error err.
+func peerError(req *http.Request, err error) error {
+	kind := ErrUnreachable
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = ErrTimeout
+	} else if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &PeerError{
+		Kind: kind,
+		Host: req.URL.Host,
+		Err:  err,
+	}
+}
@@ -0,0 +1,176 @@
+package tor
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerClientDo(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// Status of each attempt (the last one repeats), zero to stall
+		statuses []int
+		body     string
+		limit    int64
+		attempts int32
+		kind     error
+		status   int
+	}{
+		{
+			name:     "ok",
+			statuses: []int{200},
+			body:     "hello",
+			attempts: 1,
+		},
+		{
+			name:     "not modified",
+			statuses: []int{304},
+			attempts: 1,
+		},
+		{
+			name:     "retried until available",
+			statuses: []int{503, 502, 200},
+			body:     "hello",
+			attempts: 3,
+		},
+		{
+			name:     "retries exhausted",
+			statuses: []int{503},
+			attempts: 3,
+			kind:     ErrBadResponse,
+			status:   503,
+		},
+		{
+			name:     "client error not retried",
+			statuses: []int{404, 200},
+			attempts: 1,
+			kind:     ErrBadResponse,
+			status:   404,
+		},
+		{
+			name:     "post not retried",
+			method:   "POST",
+			statuses: []int{503, 200},
+			attempts: 1,
+			kind:     ErrBadResponse,
+			status:   503,
+		},
+		{
+			name:     "timeout retried",
+			statuses: []int{0},
+			attempts: 3,
+			kind:     ErrTimeout,
+		},
+		{
+			name:     "post timeout not retried",
+			method:   "POST",
+			statuses: []int{0, 200},
+			attempts: 1,
+			kind:     ErrTimeout,
+		},
+		{
+			name:     "body at limit",
+			statuses: []int{200},
+			body:     "0123456789",
+			limit:    10,
+			attempts: 1,
+		},
+		{
+			name:     "body over limit",
+			statuses: []int{200},
+			body:     "0123456789a",
+			limit:    10,
+			attempts: 1,
+			kind:     ErrBadResponse,
+		},
+		{
+			name:     "body over default limit",
+			statuses: []int{200},
+			body:     strings.Repeat("x", 101),
+			attempts: 1,
+			kind:     ErrBadResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			// Stalled attempts are released once the test is done
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&attempts, 1))
+				if n > len(tt.statuses) {
+					n = len(tt.statuses)
+				}
+				status := tt.statuses[n-1]
+				if status == 0 {
+					<-release
+					return
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			defer close(release)
+			pc := &PeerClient{
+				Client:     srv.Client(),
+				Timeout:    100 * time.Millisecond,
+				MaxSize:    100,
+				Retries:    2,
+				RetryDelay: time.Millisecond,
+			}
+			method := tt.method
+			if len(method) == 0 {
+				method = "GET"
+			}
+			req, err := http.NewRequest(method, srv.URL, strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := pc.Do(req, tt.limit)
+			if n := atomic.LoadInt32(&attempts); n != tt.attempts {
+				t.Errorf("got %d attempts, want %d", n, tt.attempts)
+			}
+			if tt.kind == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(res.Body) != tt.body {
+					t.Errorf("got body %q, want %q", res.Body, tt.body)
+				}
+				return
+			}
+			if !errors.Is(err, tt.kind) {
+				t.Fatalf("got error %v, want %v", err, tt.kind)
+			}
+			var pe *PeerError
+			if !errors.As(err, &pe) || pe.Status != tt.status {
+				t.Errorf("got error %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestPeerClientUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	pc := &PeerClient{
+		Client:     srv.Client(),
+		Timeout:    time.Second,
+		MaxSize:    100,
+		RetryDelay: time.Millisecond,
+	}
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.Do(req, 0)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("got error %v, want %v", err, ErrUnreachable)
+	}
+}
@@ -9,8 +9,10 @@ import (
 )
 
 type Tor struct {
-	Config     *Config
-	Client     *http.Client
+	Config *Config
+	Client *http.Client
+	// Client for requests to peers (wrapping Client)
+	PeerClient *PeerClient
 	Controller *torgo.Controller
 }
 
@@ -20,6 +22,8 @@ type Config struct {
 	ControlHost     string
 	ControlPort     int
 	ControlPassword string
+	// Use separate circuits for each peer
+	IsolateStreams bool
 }
 
 func NewDefaultConfig() *Config {
@@ -29,6 +33,7 @@ func NewDefaultConfig() *Config {
 		ControlHost:     "127.0.0.1",
 		ControlPort:     9051,
 		ControlPassword: "",
+		IsolateStreams:  true,
 	}
 }
 
@@ -37,7 +42,7 @@ func NewTor(config *Config) (*Tor, error) {
 		config = NewDefaultConfig()
 	}
 	// Get client
-	client, err := NewClient(config.SocksHost, config.SocksPort)
+	client, err := NewClient(config.SocksHost, config.SocksPort, config.IsolateStreams)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +66,7 @@ func NewTor(config *Config) (*Tor, error) {
 	tor := &Tor{
 		Config:     config,
 		Client:     client,
+		PeerClient: NewPeerClient(client),
 		Controller: controller,
 	}
 	return tor, nil
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"net/http"
+)
+
+// Image types that are safe to serve inline.
+var inlineTypes = map[string]bool{
+	"image/bmp":    true,
+	"image/gif":    true,
+	"image/jpeg":   true,
+	"image/png":    true,
+	"image/webp":   true,
+	"image/x-icon": true,
+}
+
+// Write raw blob data. The type is always sniffed locally (never taken from
+// a peer or uploader). Only images are served inline and everything else is
+// served as an attachment. The browser is kept from sniffing or running it.
+func BlobResponse(w http.ResponseWriter, data []byte) {
+	h := w.Header()
+	contentType := http.DetectContentType(data)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+	if inlineTypes[contentType] {
+		h.Set("Content-Type", contentType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Disposition", "attachment")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Content types of supported encodings (JSON is the default).
+const (
+	ContentTypeJson = "application/json"
+	ContentTypeCbor = "application/cbor"
+)
+
+// Window size of zstd encoders (bounds memory used per response).
+const zstdWindowSize = 1 << 17
+
+// Reused zstd encoders (nil if they can't be created).
+var zstdEncoders = sync.Pool{
+	New: func() interface{} {
+		e, err := zstd.NewWriter(
+			nil,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindowSize),
+		)
+		if err != nil {
+			return nil
+		}
+		return e
+	},
+}
+
+// ResponseWriter that compresses the body and carries the negotiated
+// content type for JsonResponse.
+type negotiatedWriter struct {
+	http.ResponseWriter
+	contentType string
+	encoding    string
+	compressor  io.WriteCloser
+	wroteHeader bool
+}
+
+// Wrap handler with content negotiation: responses are compressed with zstd
+// or gzip when accepted, and encoded as CBOR instead of JSON when compact is
+// set and the client accepts it.
+func Negotiate(h http.Handler, compact bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := &negotiatedWriter{
+			ResponseWriter: w,
+			contentType:    ContentTypeJson,
+			encoding:       acceptedEncoding(r),
+		}
+		if compact && accepts(r.Header.Get("Accept"), ContentTypeCbor) {
+			nw.contentType = ContentTypeCbor
+		}
+		w.Header().Add("Vary", "Accept, Accept-Encoding")
+		defer nw.close()
+		h.ServeHTTP(nw, r)
+	})
+}
+
+// Return preferred accepted content encoding (empty for identity).
+func acceptedEncoding(r *http.Request) string {
+	header := r.Header.Get("Accept-Encoding")
+	if accepts(header, "zstd") {
+		return "zstd"
+	}
+	if accepts(header, "gzip") {
+		return "gzip"
+	}
+	return ""
+}
+
+// Return true if comma separated header lists value (ignoring parameters
+// other than a zero quality).
+func accepts(header, value string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != value {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if strings.Replace(param, " ", "", -1) == "q=0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Return true if responses of content type are worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == ContentTypeJson || mediaType == ContentTypeCbor ||
+		strings.HasPrefix(mediaType, "text/")
+}
+
+func (nw *negotiatedWriter) WriteHeader(status int) {
+	if nw.wroteHeader {
+		return
+	}
+	nw.wroteHeader = true
+	header := nw.Header()
+	hasBody := status != http.StatusNotModified && status != http.StatusNoContent
+	if hasBody && len(nw.encoding) > 0 && compressible(header.Get("Content-Type")) {
+		nw.compressor = newCompressor(nw.encoding, nw.ResponseWriter)
+		// Fall back to identity if no compressor is available
+		if nw.compressor != nil {
+			header.Set("Content-Encoding", nw.encoding)
+			header.Del("Content-Length")
+		}
+	}
+	nw.ResponseWriter.WriteHeader(status)
+}
+
+// Return compressor of encoding writing to w (nil if unavailable).
+func newCompressor(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == "gzip" {
+		return gzip.NewWriter(w)
+	}
+	e, ok := zstdEncoders.Get().(*zstd.Encoder)
+	if !ok {
+		return nil
+	}
+	e.Reset(w)
+	return e
+}
+
+func (nw *negotiatedWriter) Write(data []byte) (int, error) {
+	if !nw.wroteHeader {
+		if len(nw.Header().Get("Content-Type")) == 0 {
+			nw.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		nw.WriteHeader(http.StatusOK)
+	}
+	if nw.compressor != nil {
+		return nw.compressor.Write(data)
+	}
+	return nw.ResponseWriter.Write(data)
+}
+
+// Flush compressed data written so far (used by event streams).
+func (nw *negotiatedWriter) Flush() {
+	if f, ok := nw.compressor.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := nw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (nw *negotiatedWriter) close() {
+	if nw.compressor == nil {
+		return
+	}
+	nw.compressor.Close()
+	// Return zstd encoder to the pool without keeping the response
+	if e, ok := nw.compressor.(*zstd.Encoder); ok {
+		e.Reset(nil)
+		zstdEncoders.Put(e)
+	}
+}
+
+// Return encoded obj and its content type as negotiated for w.
+func encode(w http.ResponseWriter, obj interface{}) ([]byte, string, error) {
+	nw, ok := w.(*negotiatedWriter)
+	if ok && nw.contentType == ContentTypeCbor {
+		data, err := cbor.Marshal(obj)
+		return data, ContentTypeCbor, err
+	}
+	data, err := json.MarshalIndent(obj, "", "  ")
+	return append(data, '\n'), ContentTypeJson, err
+}
+
+// Decode data of content type (JSON unless CBOR) into obj.
+func Decode(contentType string, data []byte, obj interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == ContentTypeCbor {
+		return cbor.Unmarshal(data, obj)
+	}
+	return json.Unmarshal(data, obj)
+}
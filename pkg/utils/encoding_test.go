@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Return body of response decompressed according to its content encoding.
+func decompress(t *testing.T, w *httptest.ResponseRecorder) []byte {
+	t.Helper()
+	var r io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNegotiate(t *testing.T) {
+	obj := map[string]string{"body": "hello"}
+	blob := []byte("\x89PNG\r\n\x1a\n")
+	tests := []struct {
+		name           string
+		compact        bool
+		accept         string
+		acceptEncoding string
+		noneMatch      bool
+		blob           bool
+		status         int
+		encoding       string
+		contentType    string
+	}{
+		{
+			name:        "identity",
+			status:      http.StatusOK,
+			contentType: ContentTypeJson,
+		},
+		{
+			name:           "gzip",
+			acceptEncoding: "gzip",
+			status:         http.StatusOK,
+			encoding:       "gzip",
+			contentType:    ContentTypeJson,
+		},
+		{
+			name:           "zstd preferred",
+			acceptEncoding: "gzip, zstd",
+			status:         http.StatusOK,
+			encoding:       "zstd",
+			contentType:    ContentTypeJson,
+		},
+		{
+			name:           "zstd refused",
+			acceptEncoding: "zstd;q=0, gzip",
+			status:         http.StatusOK,
+			encoding:       "gzip",
+			contentType:    ContentTypeJson,
+		},
+		{
+			name:           "unknown encoding",
+			acceptEncoding: "br",
+			status:         http.StatusOK,
+			contentType:    ContentTypeJson,
+		},
+		{
+			name:           "cbor",
+			compact:        true,
+			accept:         "application/cbor, application/json",
+			acceptEncoding: "zstd",
+			status:         http.StatusOK,
+			encoding:       "zstd",
+			contentType:    ContentTypeCbor,
+		},
+		{
+			name:        "cbor not offered",
+			accept:      "application/cbor",
+			status:      http.StatusOK,
+			contentType: ContentTypeJson,
+		},
+		{
+			name:           "not modified",
+			acceptEncoding: "zstd",
+			noneMatch:      true,
+			status:         http.StatusNotModified,
+		},
+		{
+			name:           "blob not compressed",
+			acceptEncoding: "zstd",
+			blob:           true,
+			status:         http.StatusOK,
+			contentType:    "image/png",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.blob {
+					w.Write(blob)
+					return
+				}
+				JsonResponseCached(w, r, obj, time.Time{})
+			}), tt.compact)
+			// Repeated to reuse pooled encoders
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("Accept", tt.accept)
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				if tt.noneMatch {
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, r)
+					r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tt.status {
+					t.Fatalf("got status %d, want %d", w.Code, tt.status)
+				}
+				if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+					t.Errorf("got encoding %q, want %q", got, tt.encoding)
+				}
+				if len(w.Header().Get("Vary")) == 0 {
+					t.Error("missing Vary header")
+				}
+				data := decompress(t, w)
+				if tt.status == http.StatusNotModified {
+					if len(data) > 0 {
+						t.Errorf("got %d bytes in 304 response", len(data))
+					}
+					continue
+				}
+				contentType := w.Header().Get("Content-Type")
+				if contentType != tt.contentType {
+					t.Errorf("got content type %q, want %q", contentType, tt.contentType)
+				}
+				if tt.blob {
+					if !bytes.Equal(data, blob) {
+						t.Error("blob changed")
+					}
+					continue
+				}
+				got := map[string]string{}
+				err := Decode(contentType, data, &got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, obj) {
+					t.Errorf("got %v, want %v", got, obj)
+				}
+			}
+		})
+	}
+}
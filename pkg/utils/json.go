@@ -1,30 +1,95 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/wybiral/pub/pkg/types"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// Write response encoded as negotiated by Negotiate (JSON by default).
 func JsonResponse(w http.ResponseWriter, obj interface{}) {
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	err := encoder.Encode(obj)
+	data, contentType, err := encode(w, obj)
 	if err != nil {
 		JsonError(w, "marshalling error")
 		return
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// Write JSON response with an ETag of its content and a Last-Modified time
+// (unless zero), or an empty 304 response if the client copy is current.
+// The ETag is weak since it's shared by every content encoding.
+func JsonResponseCached(w http.ResponseWriter, r *http.Request, obj interface{}, modified time.Time) {
+	data, contentType, err := encode(w, obj)
+	if err != nil {
+		JsonError(w, "marshalling error")
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// Return true if conditional request headers match etag (using weak
+// comparison) or modified time. If-Modified-Since is only checked when
+// If-None-Match is absent.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	match := r.Header.Get("If-None-Match")
+	if len(match) > 0 {
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if strings.TrimPrefix(tag, "W/") == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
 }
 
 func JsonError(w http.ResponseWriter, msg string) {
-	w.WriteHeader(http.StatusInternalServerError)
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
+	JsonErrorStatus(w, http.StatusInternalServerError, msg)
+}
+
+func JsonErrorStatus(w http.ResponseWriter, status int, msg string) {
 	obj := types.Error{
 		Error: msg,
 	}
-	err := encoder.Encode(obj)
+	data, contentType, err := encode(w, obj)
 	if err != nil {
 		return
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Decode request body as JSON (or CBOR if sent with that content type).
+func JsonRequest(r *http.Request, obj interface{}) error {
+	if r.Header.Get("Content-Type") == ContentTypeCbor {
+		return cbor.NewDecoder(r.Body).Decode(obj)
+	}
+	decoder := json.NewDecoder(r.Body)
+	return decoder.Decode(obj)
 }
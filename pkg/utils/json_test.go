@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := `W/"abc"`
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	at := func(d time.Duration) string {
+		return modified.Add(d).Format(http.TimeFormat)
+	}
+	tests := []struct {
+		name        string
+		noneMatch   string
+		since       string
+		modified    time.Time
+		notModified bool
+	}{
+		{"no conditions", "", "", modified, false},
+		{"same etag", `W/"abc"`, "", modified, true},
+		{"strong form of etag", `"abc"`, "", modified, true},
+		{"etag in list", `"x", W/"abc"`, "", modified, true},
+		{"any etag", "*", "", modified, true},
+		{"other etag", `W/"x"`, "", modified, false},
+		{"etag takes precedence", `W/"x"`, at(time.Hour), modified, false},
+		{"not modified since", "", at(0), modified, true},
+		{"modified since", "", at(-time.Second), modified, false},
+		{"later date", "", at(time.Hour), modified, true},
+		{"unknown modified time", "", at(0), time.Time{}, false},
+		{"bad date", "", "yesterday", modified, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if len(tt.noneMatch) > 0 {
+				r.Header.Set("If-None-Match", tt.noneMatch)
+			}
+			if len(tt.since) > 0 {
+				r.Header.Set("If-Modified-Since", tt.since)
+			}
+			got := notModified(r, etag, tt.modified)
+			if got != tt.notModified {
+				t.Errorf("got %v, want %v", got, tt.notModified)
+			}
+		})
+	}
+}
+
+func TestJsonResponseCached(t *testing.T) {
+	obj := map[string]string{"a": "b"}
+	w := httptest.NewRecorder()
+	JsonResponseCached(w, httptest.NewRequest("GET", "/", nil), obj, time.Time{})
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || len(etag) == 0 || w.Body.Len() == 0 {
+		t.Fatalf("got status %d etag %q", w.Code, etag)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	JsonResponseCached(w, r, obj, time.Time{})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d with %d bytes, want empty 304", w.Code, w.Body.Len())
+	}
+}